@@ -0,0 +1,232 @@
+package fwebpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	aesgcmAuthInfo                 = []byte("Content-Encoding: auth\x00")
+	aesgcmContentEncryptionKeyInfo = []byte("Content-Encoding: aesgcm\x00")
+	aesgcmContextLabel             = []byte("P-256\x00")
+)
+
+// Pre-allocated byte buffer format for the legacy aesgcm encoding.
+// Context:
+//   - label (6)
+//   - dhLen (2)
+//   - dh (65)
+//   - localPublicKeyLen (2)
+//   - localPublicKey (65)
+//
+// Record:
+//   - [record] padLen (2)
+//   - [record] padding
+//   - [record] data
+//   - [record] gcmTag (16)
+const (
+	aesgcmPadLenLen = 2
+	// aesgcmDefaultRS is the record size assumed by the receivers when the Encryption header has no rs.
+	aesgcmDefaultRS = 4096
+
+	aesgcmContextLen             = 6 + 2 + p256dhLen + 2 + localPublicKeyLen
+	aesgcmKeyBufLen              = authSecretLen + saltLen + hkdfLen + aesgcmContextLen
+	aesgcmContextDhOffset        = 6 + 2
+	aesgcmContextPublicKeyOffset = aesgcmContextDhOffset + p256dhLen + 2
+)
+
+// encryptAESGCM encrypt the message using the legacy aesgcm content coding (draft-ietf-webpush-encryption-04).
+// Unlike aes128gcm, the salt and local public key are not part of the record,
+// so the Encryption header value is returned, and the local public key must be sent using the Crypto-Key header.
+// The record is appended to dst.
+func (p *VAPIDPusher) encryptAESGCM(dst []byte, message []byte, sub *ParsedSubscription, keys reusableKey, options Options) (record []byte, encryption string, err error) {
+	// Pre-alloc for record.
+	dataLen := aesgcmPadLenLen + len(message)
+	recordLen := dataLen + gcmTagLen
+	if p.maxRecordSize > 0 && recordLen > p.maxRecordSize {
+		return nil, "", fmt.Errorf("size %d exceeds %d %w", recordLen, p.maxRecordSize, ErrMaxSizeExceeded)
+	}
+	recordSize, err := p.paddedSize(recordLen, options)
+	if err != nil {
+		return nil, "", err
+	}
+	padLen := 0
+	if recordLen < recordSize {
+		padLen = recordSize - recordLen
+		recordLen = recordSize
+		dataLen += padLen
+	}
+	start := len(dst)
+	record = slices.Grow(dst, recordLen)[:start+recordLen]
+
+	// Copy auth and P256dh, then derive ECDH shared secret.
+	// Pooled buffer for keys, every part is written before being read.
+	pooledKeyBuf := getKeyBuf()
+	defer p.releaseKeyBuf(pooledKeyBuf)
+	keyBuf := pooledKeyBuf[:aesgcmKeyBufLen]
+	authSecret := keyBuf[:authSecretLen:authSecretLen]
+	salt := keyBuf[authSecretLen : authSecretLen+saltLen : authSecretLen+saltLen]
+	bufHKDF := keyBuf[authSecretLen+saltLen : authSecretLen+saltLen+hkdfLen : authSecretLen+saltLen+hkdfLen]
+	context := keyBuf[authSecretLen+saltLen+hkdfLen:]
+	if sub.publicKey == nil {
+		return nil, "", fmt.Errorf("missing subscription keys %w", ErrEncryption)
+	}
+	copy(authSecret, sub.auth[:])
+	copy(context[aesgcmContextDhOffset:aesgcmContextDhOffset+p256dhLen], sub.p256dh[:])
+	sharedECDHSecret, err := keys.localPrivateKey.ECDH(sub.publicKey)
+	if err != nil {
+		return nil, "", errors.Join(ErrEncryption, err)
+	}
+	putAESGCMContext(context, keys.localPublicKeyBytes)
+
+	// GENERATE PAYLOAD.
+	if err = p.genSalt(salt); err != nil {
+		return nil, "", errors.Join(ErrEncryption, err)
+	}
+	contentEncryptionKey, nonce, err := deriveAESGCMKeys(sharedECDHSecret, authSecret, salt, context, bufHKDF)
+	p.wipe(sharedECDHSecret)
+	if err != nil {
+		return nil, "", errors.Join(ErrEncryption, err)
+	}
+	c, err := aes.NewCipher(contentEncryptionKey)
+	if err != nil {
+		return nil, "", errors.Join(ErrEncryption, err)
+	}
+	gcm, err := cipher.NewGCMWithTagSize(c, gcmTagLen)
+	if err != nil {
+		return nil, "", errors.Join(ErrEncryption, err)
+	}
+
+	// Padding is prepended to the data.
+	data := record[start : start+dataLen : start+recordLen]
+	binary.BigEndian.PutUint16(data, uint16(padLen))
+	clear(data[aesgcmPadLenLen : aesgcmPadLenLen+padLen])
+	copy(data[aesgcmPadLenLen+padLen:], message)
+	gcm.Seal(data[:0], nonce, data, nil)
+	encryption = "salt=" + encodeBase64String(salt)
+	// A record filling the record size is not the last one, so the rs is sent for larger records.
+	if dataLen >= aesgcmDefaultRS {
+		encryption += ";rs=" + strconv.Itoa(dataLen+1)
+	}
+	return record, encryption, nil
+}
+
+// putAESGCMContext write the aesgcm key derivation context into a pre-allocated buffer,
+// which already contains the receiver public key (dh) at its offset.
+func putAESGCMContext(context []byte, localPublicKeyBytes []byte) {
+	copy(context, aesgcmContextLabel)
+	binary.BigEndian.PutUint16(context[len(aesgcmContextLabel):], p256dhLen)
+	binary.BigEndian.PutUint16(context[aesgcmContextPublicKeyOffset-2:], localPublicKeyLen)
+	copy(context[aesgcmContextPublicKeyOffset:], localPublicKeyBytes)
+}
+
+// deriveAESGCMKeys derive the content encryption key and nonce of the aesgcm content coding.
+// The dst buffer must have a length of at least [hkdfLen].
+func deriveAESGCMKeys(sharedECDHSecret, authSecret, salt, context, dst []byte) (contentEncryptionKey, nonce []byte, err error) {
+	hash := sha256.New
+	ikm, err := getHKDFKey(hkdf.New(hash, sharedECDHSecret, authSecret, aesgcmAuthInfo), dst[:32:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	info := make([]byte, 0, len(aesgcmContentEncryptionKeyInfo)+len(context))
+	info = append(append(info, aesgcmContentEncryptionKeyInfo...), context...)
+	contentEncryptionKey, err = getHKDFKey(hkdf.New(hash, ikm, salt, info), dst[32:48:48])
+	if err != nil {
+		return nil, nil, err
+	}
+	info = append(append(info[:0], nonceInfo...), context...)
+	nonce, err = getHKDFKey(hkdf.New(hash, ikm, salt, info), dst[48:60:60])
+	if err != nil {
+		return nil, nil, err
+	}
+	return contentEncryptionKey, nonce, nil
+}
+
+// DecryptAESGCMNotification decrypts a legacy aesgcm push message body (draft-ietf-webpush-encryption-04),
+// using the salt from the Encryption header and the sender public key from the Crypto-Key header.
+// This is the receiver (user agent) side, see [DecryptNotification].
+func DecryptAESGCMNotification(body []byte, header http.Header, privateKey *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if privateKey == nil {
+		return nil, fmt.Errorf("missing private key %w", ErrDecryption)
+	}
+	if len(authSecret) != authSecretLen {
+		return nil, fmt.Errorf("invalid auth secret length %d %w", len(authSecret), ErrDecryption)
+	}
+	salt, err := decodeBase64(headerParam(header.Get("Encryption"), "salt"))
+	if err != nil || len(salt) != saltLen {
+		return nil, fmt.Errorf("invalid Encryption salt %w", ErrDecryption)
+	}
+	localPublicKeyBytes, err := decodeBase64(headerParam(header.Get("Crypto-Key"), "dh"))
+	if err != nil || len(localPublicKeyBytes) != localPublicKeyLen {
+		return nil, fmt.Errorf("invalid Crypto-Key dh %w", ErrDecryption)
+	}
+	if len(body) < aesgcmPadLenLen+gcmTagLen {
+		return nil, fmt.Errorf("truncated record %w", ErrDecryption)
+	}
+	rs := aesgcmDefaultRS
+	if param := headerParam(header.Get("Encryption"), "rs"); param != "" {
+		rs, err = strconv.Atoi(param)
+		if err != nil || rs <= aesgcmPadLenLen {
+			return nil, fmt.Errorf("invalid Encryption rs %w", ErrDecryption)
+		}
+	}
+	// Only the single record bodies are supported.
+	if len(body)-gcmTagLen >= rs {
+		return nil, fmt.Errorf("record size %d exceeds rs %d %w", len(body)-gcmTagLen, rs, ErrDecryption)
+	}
+
+	localPublicKey, err := privateKey.Curve().NewPublicKey(localPublicKeyBytes)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	sharedECDHSecret, err := privateKey.ECDH(localPublicKey)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	context := make([]byte, aesgcmContextLen)
+	copy(context[aesgcmContextDhOffset:], privateKey.PublicKey().Bytes())
+	putAESGCMContext(context, localPublicKeyBytes)
+	contentEncryptionKey, nonce, err := deriveAESGCMKeys(sharedECDHSecret, authSecret, salt, context, make([]byte, hkdfLen))
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	c, err := aes.NewCipher(contentEncryptionKey)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	gcm, err := cipher.NewGCMWithTagSize(c, gcmTagLen)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	data, err := gcm.Open(nil, nonce, body, nil)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	padLen := int(binary.BigEndian.Uint16(data))
+	if aesgcmPadLenLen+padLen > len(data) {
+		return nil, fmt.Errorf("invalid padding length %w", ErrDecryption)
+	}
+	return data[aesgcmPadLenLen+padLen:], nil
+}
+
+// headerParam returns the value of a parameter from an Encryption or Crypto-Key header value,
+// for example: headerParam("dh=abc;p256ecdsa=def", "p256ecdsa") returns "def".
+func headerParam(value string, name string) string {
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && k == name {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
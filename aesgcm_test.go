@@ -0,0 +1,101 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestAESGCMEncoding(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []VAPIDPusherOption
+		sub     ContentEncoding
+		opts    Options
+	}{
+		{"pusher", []VAPIDPusherOption{WithContentEncoding(ContentEncodingAESGCM)}, ContentEncodingUnset, Options{}},
+		{"subscription", nil, ContentEncodingAESGCM, Options{}},
+		{"options", []VAPIDPusherOption{WithContentEncoding(ContentEncodingAES128GCM)}, ContentEncodingAES128GCM, Options{ContentEncoding: ContentEncodingAESGCM}},
+		{"padding", nil, ContentEncodingAESGCM, Options{RecordSize: 1024}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, c.options...)
+			sub, privateKey, authSecret := newTestReceiver(t)
+			sub.ContentEncoding = c.sub
+
+			req, err := p.PrepareNotificationRequest(context.Background(), message, &sub, c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding := req.Header.Get("Content-Encoding"); encoding != "aesgcm" {
+				t.Fatalf("Incorrect Content-Encoding, expected=aesgcm, got=%s", encoding)
+			}
+			if key := headerParam(req.Header.Get("Crypto-Key"), "p256ecdsa"); key != p.vapid.publicKey {
+				t.Fatalf("Incorrect Crypto-Key p256ecdsa, expected=%s, got=%s", p.vapid.publicKey, key)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.opts.RecordSize > 0 && len(body) != c.opts.RecordSize {
+				t.Fatalf("Incorrect padded size, expected=%d, got=%d", c.opts.RecordSize, len(body))
+			}
+
+			plaintext, err := DecryptAESGCMNotification(body, req.Header, privateKey, authSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, message) {
+				t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+			}
+		})
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	p := newTestPusher(t)
+	sub, _, _ := newTestReceiver(t)
+	sub.ContentEncoding = "aes256gcm"
+	_, err := p.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+	if !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("Expected ErrUnsupportedEncoding, got=%v", err)
+	}
+}
+
+func TestAESGCMLargeRecord(t *testing.T) {
+	p := newTestPusher(t, WithContentEncoding(ContentEncodingAESGCM), WithMaxRecordSize(0))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	large := bytes.Repeat([]byte("a"), 5000)
+	msg, err := p.EncryptNotification(large, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := headerParam(msg.Header.Get("Encryption"), "rs"); rs != "5003" {
+		t.Fatalf("Incorrect Encryption rs, expected=5003, got=%s", rs)
+	}
+	plaintext, err := DecryptAESGCMNotification(msg.Body, msg.Header, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, large) {
+		t.Fatal("Incorrect plaintext")
+	}
+
+	// Without rs, the record exceeds the default record size.
+	msg.Header.Set("Encryption", "salt="+headerParam(msg.Header.Get("Encryption"), "salt"))
+	if _, err := DecryptAESGCMNotification(msg.Body, msg.Header, privateKey, authSecret); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("Expected ErrDecryption, got=%v", err)
+	}
+
+	// Small records keep the default record size.
+	msg, err = p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := headerParam(msg.Header.Get("Encryption"), "rs"); rs != "" {
+		t.Fatalf("Unexpected Encryption rs, got=%s", rs)
+	}
+}
@@ -0,0 +1,93 @@
+package fwebpush
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compressed payload envelope header, see [WithPayloadCompression].
+const (
+	// PayloadUncompressed marks a payload sent as is.
+	PayloadUncompressed = 0
+	// PayloadDeflate marks a payload compressed using raw deflate (RFC 1951).
+	PayloadDeflate = 1
+
+	// maxDecompressedPayloadLen limits the decompressed size, as a record is at most a few KB.
+	maxDecompressedPayloadLen = 1 << 20
+)
+
+var ErrInvalidPayload = errors.New("invalid payload")
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		// Never fails with a valid level.
+		w, _ := flate.NewWriter(nil, flate.BestCompression)
+		return w
+	},
+}
+
+// encodePayload signs then compresses the message, as configured.
+func (p *VAPIDPusher) encodePayload(message []byte, encoding ContentEncoding, options Options, now time.Time) ([]byte, error) {
+	message, err := p.signPayload(message, now)
+	if err != nil {
+		return nil, err
+	}
+	if !p.compressPayload {
+		return message, nil
+	}
+	return p.compress(message, encoding, options)
+}
+
+// compress prepends the compression header to the message,
+// compressing it only when the uncompressed message exceeds the max record size.
+func (p *VAPIDPusher) compress(message []byte, encoding ContentEncoding, options Options) ([]byte, error) {
+	if p.maxRecordSize <= 0 || p.recordLen(encoding, 1+len(message), options) <= p.maxRecordSize {
+		return append([]byte{PayloadUncompressed}, message...), nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(message)/2))
+	buf.WriteByte(PayloadDeflate)
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(message); err != nil {
+		return nil, errors.Join(ErrEncryption, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Join(ErrEncryption, err)
+	}
+	// Compression does not help, the size is checked when encrypting.
+	if buf.Len() > 1+len(message) {
+		return append([]byte{PayloadUncompressed}, message...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressPayload decodes a payload encoded by [WithPayloadCompression].
+func DecompressPayload(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty payload %w", ErrInvalidPayload)
+	}
+	switch payload[0] {
+	case PayloadUncompressed:
+		return payload[1:], nil
+	case PayloadDeflate:
+		r := flate.NewReader(bytes.NewReader(payload[1:]))
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedPayloadLen+1))
+		if err != nil {
+			return nil, errors.Join(ErrInvalidPayload, err)
+		}
+		if len(decompressed) > maxDecompressedPayloadLen {
+			return nil, fmt.Errorf("decompressed payload exceeds %d %w", maxDecompressedPayloadLen, ErrInvalidPayload)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %d %w", payload[0], ErrInvalidPayload)
+	}
+}
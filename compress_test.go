@@ -0,0 +1,145 @@
+package fwebpush
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func newTestJSONPayload(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"items":[`)
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":%d,"title":"Notification title %d","body":"Notification body"}`, i, i)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+func TestPayloadCompression(t *testing.T) {
+	large := newTestJSONPayload(100)
+	if len(large) <= MaxRecordSize {
+		t.Fatalf("Payload too small %d", len(large))
+	}
+	for _, encoding := range []ContentEncoding{ContentEncodingAES128GCM, ContentEncodingAESGCM} {
+		for _, c := range []struct {
+			name       string
+			payload    []byte
+			compressed bool
+		}{
+			{"small", message, false},
+			{"large", large, true},
+		} {
+			t.Run(string(encoding)+"/"+c.name, func(t *testing.T) {
+				p := newTestPusher(t, WithContentEncoding(encoding), WithPayloadCompression())
+				sub, privateKey, authSecret := newTestReceiver(t)
+				msg, err := p.EncryptNotification(c.payload, &sub, Options{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var plaintext []byte
+				if encoding == ContentEncodingAESGCM {
+					plaintext, err = DecryptAESGCMNotification(msg.Body, msg.Header, privateKey, authSecret)
+				} else {
+					plaintext, err = DecryptNotification(msg.Body, privateKey, authSecret)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed := plaintext[0] == PayloadDeflate; compressed != c.compressed {
+					t.Fatalf("Incorrect compression, expected=%v, got=%v", c.compressed, compressed)
+				}
+				decompressed, err := DecompressPayload(plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decompressed, c.payload) {
+					t.Fatalf("Incorrect payload, expected=%q, got=%q", c.payload, decompressed)
+				}
+
+				// Too large without compression.
+				p = newTestPusher(t, WithContentEncoding(encoding))
+				if _, err := p.EncryptNotification(c.payload, &sub, Options{}); c.compressed != errors.Is(err, ErrMaxSizeExceeded) {
+					t.Fatalf("Incorrect error without compression, got=%v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestPayloadCompressionIncompressible(t *testing.T) {
+	payload := make([]byte, MaxRecordSize)
+	_, _ = rand.Read(payload)
+	p := newTestPusher(t, WithPayloadCompression())
+	sub, _, _ := newTestReceiver(t)
+	if _, err := p.EncryptNotification(payload, &sub, Options{}); !errors.Is(err, ErrMaxSizeExceeded) {
+		t.Fatalf("Expected ErrMaxSizeExceeded, got=%v", err)
+	}
+}
+
+func TestPayloadCompressionSigned(t *testing.T) {
+	edKey, _ := newTestPayloadKeys(t)
+	signer, err := NewPayloadSigner("key", edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewPayloadVerifier(map[string]crypto.PublicKey{"key": edKey.Public()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := newTestJSONPayload(100)
+	p := newTestPusher(t, WithPayloadSigner(signer), WithPayloadCompression())
+	sub, privateKey, authSecret := newTestReceiver(t)
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := p.AppendEncryptedParsed(nil, payload, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := DecryptNotification(body, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := DecompressPayload(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := verifier.Verify(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signed.Payload, payload) {
+		t.Fatal("Incorrect payload")
+	}
+}
+
+func TestDecompressPayloadInvalid(t *testing.T) {
+	var bomb bytes.Buffer
+	bomb.WriteByte(PayloadDeflate)
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	_, _ = w.Write(make([]byte, maxDecompressedPayloadLen+1))
+	_ = w.Close()
+
+	cases := map[string][]byte{
+		"empty":       nil,
+		"unsupported": {2, 0},
+		"corrupted":   {PayloadDeflate, 0xff, 0xff},
+		"too large":   bomb.Bytes(),
+	}
+	for name, payload := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DecompressPayload(payload); !errors.Is(err, ErrInvalidPayload) {
+				t.Fatalf("Expected ErrInvalidPayload, got=%v", err)
+			}
+		})
+	}
+}
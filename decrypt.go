@@ -0,0 +1,61 @@
+package fwebpush
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/mawngo/go-fwebpush/ece"
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrDecryption = errors.New("decryption error")
+
+// DecryptNotification decrypts an aes128gcm push message body, as produced by [VAPIDPusher.PrepareNotificationRequest].
+// This is the receiver (user agent) side of RFC8291, which is normally done by the browser,
+// privateKey is the user agent private key (matching Keys.P256dh) and authSecret is the decoded Keys.Auth.
+//
+// Useful for testing and debugging payloads without a browser.
+// FOR MORE INFORMATION SEE RFC8291: https://datatracker.ietf.org/doc/rfc8291.
+func DecryptNotification(body []byte, privateKey *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if privateKey == nil {
+		return nil, fmt.Errorf("missing private key %w", ErrDecryption)
+	}
+	if len(authSecret) != authSecretLen {
+		return nil, fmt.Errorf("invalid auth secret length %d %w", len(authSecret), ErrDecryption)
+	}
+	// PARSE HEADER.
+	header, err := ece.ParseHeader(body)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	if len(header.KeyID) != localPublicKeyLen {
+		return nil, fmt.Errorf("invalid keyid length %d %w", len(header.KeyID), ErrDecryption)
+	}
+
+	// DERIVE IKM.
+	localPublicKey, err := privateKey.Curve().NewPublicKey(header.KeyID)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	sharedECDHSecret, err := privateKey.ECDH(localPublicKey)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	dh := privateKey.PublicKey().Bytes()
+	prkInfo := make([]byte, 0, webPushInfoLen+len(dh)+len(header.KeyID))
+	prkInfo = append(prkInfo, webpushInfo...)
+	prkInfo = append(prkInfo, dh...)
+	prkInfo = append(prkInfo, header.KeyID...)
+	ikm, err := getHKDFKey(hkdf.New(sha256.New, sharedECDHSecret, authSecret, prkInfo), make([]byte, 32))
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+
+	// DECRYPT AND STRIP PADDING.
+	plaintext, err := ece.Decrypt(ikm, body)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,129 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestReceiver generate a user agent key pair and return the matching subscription.
+func newTestReceiver(t testing.TB) (Subscription, *ecdh.PrivateKey, []byte) {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, authSecretLen)
+	if _, err := rand.Read(authSecret); err != nil {
+		t.Fatal(err)
+	}
+	sub := Subscription{
+		Endpoint: "https://updates.push.services.mozilla.com/wpush/v2/gAAAAA",
+		Keys: Keys{
+			Auth:   encodeBase64String(authSecret),
+			P256dh: encodeBase64String(privateKey.PublicKey().Bytes()),
+		},
+	}
+	return sub, privateKey, authSecret
+}
+
+func newTestPusher(t testing.TB, options ...VAPIDPusherOption) *VAPIDPusher {
+	vapidPrivateKey, vapidPublicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewVAPIDPusher("test@test.com", vapidPublicKey, vapidPrivateKey, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+type preparedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func readRequest(t testing.TB, p *VAPIDPusher, message []byte, sub *Subscription, options Options) preparedRequest {
+	req, err := p.PrepareNotificationRequest(context.Background(), message, sub, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return preparedRequest{header: req.Header, body: body}
+}
+
+func readRequestBody(t testing.TB, p *VAPIDPusher, message []byte, sub *Subscription, options Options) []byte {
+	return readRequest(t, p, message, sub, options).body
+}
+
+func TestDecryptNotification(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []VAPIDPusherOption
+		message []byte
+	}{
+		{"default", nil, message},
+		{"empty", nil, []byte{}},
+		{"padding", []VAPIDPusherOption{WithRecordSize(1024)}, message},
+		{"no caching", []VAPIDPusherOption{WithVAPIDTokenTTL(0)}, message},
+		{"local secret caching", []VAPIDPusherOption{WithLocalSecretTTL(time.Hour)}, message},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, c.options...)
+			sub, privateKey, authSecret := newTestReceiver(t)
+			// Send twice so the local secret caching path is also covered.
+			for range 2 {
+				body := readRequestBody(t, p, c.message, &sub, Options{})
+				plaintext, err := DecryptNotification(body, privateKey, authSecret)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plaintext, c.message) {
+					t.Fatalf("Incorrect plaintext, expected=%q, got=%q", c.message, plaintext)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptNotificationInvalid(t *testing.T) {
+	p := newTestPusher(t)
+	sub, privateKey, authSecret := newTestReceiver(t)
+	body := readRequestBody(t, p, message, &sub, Options{})
+
+	_, otherPrivateKey, otherAuthSecret := newTestReceiver(t)
+	tampered := bytes.Clone(body)
+	tampered[len(tampered)-1] ^= 1
+
+	cases := []struct {
+		name       string
+		body       []byte
+		privateKey *ecdh.PrivateKey
+		authSecret []byte
+	}{
+		{"wrong private key", body, otherPrivateKey, authSecret},
+		{"wrong auth secret", body, privateKey, otherAuthSecret},
+		{"tampered", tampered, privateKey, authSecret},
+		{"truncated header", body[:dataOffset-1], privateKey, authSecret},
+		{"truncated record", body[:dataOffset+gcmTagLen], privateKey, authSecret},
+		{"invalid auth secret", body, privateKey, authSecret[:8]},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := DecryptNotification(c.body, c.privateKey, c.authSecret)
+			if !errors.Is(err, ErrDecryption) {
+				t.Fatalf("Expected ErrDecryption, got=%v", err)
+			}
+		})
+	}
+}
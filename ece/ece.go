@@ -0,0 +1,374 @@
+// Package ece implements the aes128gcm Encrypted Content-Encoding for HTTP (RFC8188),
+// with arbitrary input keying material (IKM) and keyid.
+//
+// The encoded body format:
+//   - [header] salt (16)
+//   - [header] rs (4)
+//   - [header] idlen (1)
+//   - [header] keyid (idlen)
+//   - [record] data (up to rs - 17)
+//   - [record] padding delimiter (1), 2 for the last record, 1 for the others
+//   - [record] padding
+//   - [record] gcmTag (16)
+//
+// Each record is exactly rs octets, except the last record which can be shorter.
+// The nonce of each record is the derived nonce XOR the record sequence number.
+//
+// FOR MORE INFORMATION SEE RFC8188: https://datatracker.ietf.org/doc/rfc8188.
+package ece
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// SaltLen is the length of the salt.
+	SaltLen = 16
+	// KeyLen is the length of the content encryption key.
+	KeyLen = 16
+	// NonceLen is the length of the nonce.
+	NonceLen = 12
+	// TagLen is the length of the AEAD_AES_128_GCM authentication tag.
+	TagLen = 16
+	// MaxKeyIDLen is the maximum length of the keyid.
+	MaxKeyIDLen = 255
+	// RecordOverhead is the overhead of each record: padding delimiter (1 octet) and the gcm tag.
+	RecordOverhead = 1 + TagLen
+	// MinRS is the minimum record size, which can hold 1 octet of data.
+	MinRS = RecordOverhead + 1
+	// DefaultRS is the record size written in the header for a single record body,
+	// unless the record is larger.
+	DefaultRS = 4096
+
+	rsLen         = 4
+	rsOffset      = SaltLen
+	keyIDOffset   = rsOffset + rsLen
+	minHeaderLen  = keyIDOffset + 1
+	delimiter     = 1
+	lastDelimiter = 2
+)
+
+var (
+	nonceInfo                = []byte("Content-Encoding: nonce\x00")
+	contentEncryptionKeyInfo = []byte("Content-Encoding: aes128gcm\x00")
+)
+
+var (
+	ErrInvalidParams = errors.New("invalid encryption params")
+	ErrDecryption    = errors.New("decryption error")
+)
+
+// Params are the header values and padding of an encoded body.
+type Params struct {
+	// Salt, must be 16 random octets, unique for each message encrypted with the same IKM.
+	// Optional, generated using crypto/rand if nil.
+	Salt []byte
+	// KeyID identifies the IKM to the receiver, up to 255 octets.
+	KeyID []byte
+	// RS is the record size, splitting the message into multiple records.
+	// Optional, 0 means the whole message is written into a single record.
+	RS int
+	// Pad is the total length of padding.
+	Pad int
+}
+
+// Header is the decoded header of an encoded body.
+type Header struct {
+	Salt  []byte
+	RS    uint32
+	KeyID []byte
+}
+
+// Len returns the encoded length of the header.
+func (h Header) Len() int {
+	return HeaderLen(len(h.KeyID))
+}
+
+// HeaderLen returns the length of the header with a keyid of the specified length.
+func HeaderLen(keyIDLen int) int {
+	return minHeaderLen + keyIDLen
+}
+
+// RecordsLen returns the total length of the records holding n octets of content (data and padding).
+// An rs <= 0 means that all content is written into a single record.
+func RecordsLen(n int, rs int) int {
+	if rs <= 0 {
+		return n + RecordOverhead
+	}
+	chunk := rs - RecordOverhead
+	records := max((n+chunk-1)/chunk, 1)
+	return n + records*RecordOverhead
+}
+
+// ContentLen returns the maximum length of content (data and padding)
+// so that the records fit in the specified size.
+// It is the inverse of [RecordsLen], but the records can be up to 17 octets shorter than size,
+// when the last record does not have enough room for the delimiter and the gcm tag.
+func ContentLen(size int, rs int) int {
+	if rs <= 0 {
+		return size - RecordOverhead
+	}
+	chunk := rs - RecordOverhead
+	records := (size + rs - 1) / rs
+	content := size - records*RecordOverhead
+	if records > 1 && content <= (records-1)*chunk {
+		content = (records - 1) * chunk
+	}
+	return content
+}
+
+// EncryptedLen returns the length of the encoded body.
+func EncryptedLen(plaintextLen int, params Params) int {
+	return HeaderLen(len(params.KeyID)) + RecordsLen(plaintextLen+params.Pad, params.RS)
+}
+
+// Encrypt encrypts the plaintext using the ikm, and returns the encoded body.
+func Encrypt(ikm []byte, plaintext []byte, params Params) ([]byte, error) {
+	return AppendEncrypt(nil, ikm, plaintext, params)
+}
+
+// AppendEncrypt encrypts the plaintext using the ikm, and appends the encoded body to dst.
+// The dst is grown at most once, the plaintext must not overlap the appended part of dst.
+func AppendEncrypt(dst []byte, ikm []byte, plaintext []byte, params Params) ([]byte, error) {
+	if params.Salt != nil && len(params.Salt) != SaltLen {
+		return dst, fmt.Errorf("salt length %d %w", len(params.Salt), ErrInvalidParams)
+	}
+	if len(params.KeyID) > MaxKeyIDLen {
+		return dst, fmt.Errorf("keyid length %d %w", len(params.KeyID), ErrInvalidParams)
+	}
+	if params.RS != 0 && (params.RS < MinRS || params.RS > math.MaxInt32) {
+		return dst, fmt.Errorf("rs %d %w", params.RS, ErrInvalidParams)
+	}
+	if params.Pad < 0 {
+		return dst, fmt.Errorf("pad %d %w", params.Pad, ErrInvalidParams)
+	}
+
+	start := len(dst)
+	headerLen := HeaderLen(len(params.KeyID))
+	recordsLen := RecordsLen(len(plaintext)+params.Pad, params.RS)
+	dst = grow(dst, headerLen+recordsLen)
+	body := dst[start:]
+
+	// Encryption Content-Coding Header.
+	salt := body[:SaltLen:SaltLen]
+	if params.Salt != nil {
+		copy(salt, params.Salt)
+	} else if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return dst[:start], err
+	}
+	rs := params.RS
+	if rs <= 0 {
+		// From the spec, rs must greater than the record length.
+		rs = max(recordsLen, DefaultRS)
+	}
+	binary.BigEndian.PutUint32(body[rsOffset:], uint32(rs))
+	body[keyIDOffset] = byte(len(params.KeyID))
+	copy(body[minHeaderLen:], params.KeyID)
+
+	s := scratchPool.Get().(*scratch)
+	defer s.release()
+	gcm, nonce, err := newCipher(ikm, salt, s)
+	if err != nil {
+		return dst[:start], err
+	}
+	sealRecords(gcm, nonce, &s.recordNonce, body[headerLen:], plaintext, params.Pad, params.RS)
+	return dst, nil
+}
+
+// ParseHeader decode the header of an encoded body.
+// The returned slices share the memory of body.
+func ParseHeader(body []byte) (Header, error) {
+	if len(body) < minHeaderLen {
+		return Header{}, fmt.Errorf("truncated header %w", ErrDecryption)
+	}
+	header := Header{
+		Salt: body[:SaltLen:SaltLen],
+		RS:   binary.BigEndian.Uint32(body[rsOffset:]),
+	}
+	keyIDLen := int(body[keyIDOffset])
+	if len(body) < minHeaderLen+keyIDLen {
+		return Header{}, fmt.Errorf("truncated header %w", ErrDecryption)
+	}
+	header.KeyID = body[minHeaderLen : minHeaderLen+keyIDLen : minHeaderLen+keyIDLen]
+	if header.RS < MinRS {
+		return Header{}, fmt.Errorf("invalid rs %d %w", header.RS, ErrDecryption)
+	}
+	return header, nil
+}
+
+// Decrypt decrypts an encoded body using the ikm, and returns the plaintext with padding removed.
+// Use [ParseHeader] first to read the keyid if the ikm depends on it.
+func Decrypt(ikm []byte, body []byte) ([]byte, error) {
+	header, err := ParseHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	records := body[header.Len():]
+	if len(records) < RecordOverhead {
+		return nil, fmt.Errorf("truncated record %w", ErrDecryption)
+	}
+	s := scratchPool.Get().(*scratch)
+	defer s.release()
+	gcm, nonce, err := newCipher(ikm, header.Salt, s)
+	if err != nil {
+		return nil, errors.Join(ErrDecryption, err)
+	}
+	return OpenRecords(gcm, nonce, records, int(min(header.RS, math.MaxInt32)))
+}
+
+// SealRecords encrypt the data followed by padLen octets of padding into dst, split into records of size rs.
+// The dst must have the length returned by [RecordsLen] and must not overlap data.
+// An rs <= 0 means that all content is written into a single record.
+func SealRecords(gcm cipher.AEAD, nonce []byte, dst []byte, data []byte, padLen int, rs int) {
+	var recordNonce [NonceLen]byte
+	sealRecords(gcm, nonce, &recordNonce, dst, data, padLen, rs)
+}
+
+// sealRecords is [SealRecords] using a caller-supplied buffer for the record nonce.
+func sealRecords(gcm cipher.AEAD, nonce []byte, recordNonce *[NonceLen]byte, dst []byte, data []byte, padLen int, rs int) {
+	contentLen := len(data) + padLen
+	chunk := contentLen
+	if rs > 0 {
+		chunk = rs - RecordOverhead
+	}
+	for seq, offset := 0, 0; ; seq++ {
+		start := seq * chunk
+		n := min(chunk, contentLen-start)
+		last := start+n >= contentLen
+		// Use plain slice for both plain text and cipher text.
+		plain := dst[offset : offset+n+1 : offset+n+RecordOverhead]
+		d := copy(plain, data[min(start, len(data)):min(start+n, len(data))])
+		// End padding, the padding follows the delimiter.
+		plain[d] = delimiter
+		if last {
+			plain[d] = lastDelimiter
+		}
+		clear(plain[d+1:])
+		gcm.Seal(plain[:0], recordNonceFor(recordNonce, nonce, seq), plain, nil)
+		if last {
+			return
+		}
+		offset += n + RecordOverhead
+	}
+}
+
+// OpenRecords decrypt the records of size rs and returns the data with padding removed.
+// The rs must be at least [MinRS].
+func OpenRecords(gcm cipher.AEAD, nonce []byte, records []byte, rs int) ([]byte, error) {
+	if rs < MinRS {
+		return nil, fmt.Errorf("invalid rs %d %w", rs, ErrDecryption)
+	}
+	var recordNonce [NonceLen]byte
+	data := make([]byte, 0, len(records))
+	for seq, offset := 0, 0; offset < len(records); seq++ {
+		end := min(offset+rs, len(records))
+		if end-offset < RecordOverhead {
+			return nil, fmt.Errorf("truncated record %d %w", seq, ErrDecryption)
+		}
+		start := len(data)
+		var err error
+		data, err = gcm.Open(data, recordNonceFor(&recordNonce, nonce, seq), records[offset:end], nil)
+		if err != nil {
+			return nil, fmt.Errorf("record %d %w: %w", seq, ErrDecryption, err)
+		}
+		plain, err := stripPadding(data[start:], end == len(records))
+		if err != nil {
+			return nil, err
+		}
+		data = data[:start+len(plain)]
+		offset = end
+	}
+	return data, nil
+}
+
+// DeriveKeys derive the content encryption key and the nonce from the ikm and salt into dst,
+// which must have a length of at least KeyLen + NonceLen.
+func DeriveKeys(ikm []byte, salt []byte, dst []byte) (contentEncryptionKey, nonce []byte, err error) {
+	return deriveKeys(ikm, salt, dst, newHMACSHA256(), new([sha256.Size]byte))
+}
+
+// scratch holds the derived keys, the HMAC state and outputs and the record nonce,
+// which are pooled as they escape to the heap through the cipher and the hash.
+type scratch struct {
+	keys        [KeyLen + NonceLen]byte
+	sum         [sha256.Size]byte
+	recordNonce [NonceLen]byte
+	mac         *hmacSHA256
+}
+
+var scratchPool = sync.Pool{New: func() any { return &scratch{mac: newHMACSHA256()} }}
+
+// release clears the key material and puts the scratch back to the pool, the HMAC state is wiped by deriveKeys.
+func (s *scratch) release() {
+	*s = scratch{mac: s.mac}
+	scratchPool.Put(s)
+}
+
+// newCipher derive the content encryption key and nonce into the scratch, and create the AEAD_AES_128_GCM cipher.
+func newCipher(ikm []byte, salt []byte, s *scratch) (cipher.AEAD, []byte, error) {
+	contentEncryptionKey, nonce, err := deriveKeys(ikm, salt, s.keys[:], s.mac, &s.sum)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := aes.NewCipher(contentEncryptionKey)
+	clear(contentEncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCMWithTagSize(c, TagLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
+
+// stripPadding removes the padding and the padding delimiter from a decrypted record.
+// The last record must use the delimiter 2, other records must use 1.
+func stripPadding(data []byte, last bool) ([]byte, error) {
+	for i := len(data) - 1; i >= 0; i-- {
+		switch data[i] {
+		case 0:
+			continue
+		case delimiter:
+			if last {
+				return nil, fmt.Errorf("unexpected non-last record delimiter %w", ErrDecryption)
+			}
+			return data[:i], nil
+		case lastDelimiter:
+			if !last {
+				return nil, fmt.Errorf("unexpected last record delimiter %w", ErrDecryption)
+			}
+			return data[:i], nil
+		default:
+			return nil, fmt.Errorf("invalid padding delimiter %w", ErrDecryption)
+		}
+	}
+	return nil, fmt.Errorf("missing padding delimiter %w", ErrDecryption)
+}
+
+// recordNonceFor compute the nonce of a record, which is the nonce XOR the record sequence number.
+func recordNonceFor(dst *[NonceLen]byte, nonce []byte, seq int) []byte {
+	copy(dst[:], nonce)
+	tail := binary.BigEndian.Uint64(dst[NonceLen-8:]) ^ uint64(seq)
+	binary.BigEndian.PutUint64(dst[NonceLen-8:], tail)
+	return dst[:]
+}
+
+// grow extends the length of dst by n, re-allocating at most once.
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	return dst[:len(dst)+n]
+}
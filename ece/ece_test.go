@@ -0,0 +1,178 @@
+package ece
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"testing"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC8188 section 3.1, Encryption of "I am the walrus" in a single record.
+func TestRFC8188SingleRecord(t *testing.T) {
+	ikm := mustDecode(t, "yqdlZ-tYemfogSmv7Ws5PQ")
+	salt := mustDecode(t, "I1BsxtFttlv3u_Oo94xnmw")
+	expected := mustDecode(t, "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg")
+
+	body, err := Encrypt(ikm, []byte("I am the walrus"), Params{Salt: salt, RS: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("Incorrect body, expected=%x, got=%x", expected, body)
+	}
+	plaintext, err := Decrypt(ikm, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "I am the walrus" {
+		t.Fatalf("Incorrect plaintext, got=%q", plaintext)
+	}
+}
+
+// RFC8188 section 3.2, Encryption of "I am the walrus" in multiple records, with a keyid.
+func TestRFC8188MultipleRecords(t *testing.T) {
+	ikm := mustDecode(t, "BO3ZVPxUlnLORbVGMpbT1Q")
+	body := mustDecode(t, "uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA")
+
+	header, err := ParseHeader(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.RS != 25 || string(header.KeyID) != "a1" {
+		t.Fatalf("Incorrect header, got rs=%d keyid=%q", header.RS, header.KeyID)
+	}
+	plaintext, err := Decrypt(ikm, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "I am the walrus" {
+		t.Fatalf("Incorrect plaintext, got=%q", plaintext)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ikm := make([]byte, 32)
+	if _, err := rand.Read(ikm); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("0123456789"), 100)
+	cases := []Params{
+		{},
+		{KeyID: []byte("key-1")},
+		{RS: MinRS},
+		{RS: 100, Pad: 250},
+		{RS: 1000, Pad: 1},
+		{Pad: 4096, KeyID: bytes.Repeat([]byte{1}, MaxKeyIDLen)},
+	}
+	for _, params := range cases {
+		dst := []byte("prefix")
+		body, err := AppendEncrypt(dst, ikm, plaintext, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(body, []byte("prefix")) {
+			t.Fatal("Missing dst prefix")
+		}
+		body = body[len("prefix"):]
+		if len(body) != EncryptedLen(len(plaintext), params) {
+			t.Fatalf("Incorrect length, expected=%d, got=%d", EncryptedLen(len(plaintext), params), len(body))
+		}
+		header, err := ParseHeader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(header.KeyID, params.KeyID) {
+			t.Fatalf("Incorrect keyid, expected=%q, got=%q", params.KeyID, header.KeyID)
+		}
+		decrypted, err := Decrypt(ikm, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("Incorrect plaintext for params %+v", params)
+		}
+		if _, err := Decrypt(ikm[:16], body); !errors.Is(err, ErrDecryption) {
+			t.Fatalf("Expected ErrDecryption, got=%v", err)
+		}
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	ikm := make([]byte, 16)
+	cases := []Params{
+		{Salt: make([]byte, 8)},
+		{KeyID: make([]byte, MaxKeyIDLen+1)},
+		{RS: MinRS - 1},
+		{Pad: -1},
+	}
+	for _, params := range cases {
+		if _, err := Encrypt(ikm, []byte("test"), params); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("Expected ErrInvalidParams for %+v, got=%v", params, err)
+		}
+	}
+}
+
+func TestContentLen(t *testing.T) {
+	for _, rs := range []int{0, MinRS, 64, 100, 4096} {
+		for size := RecordOverhead; size < 2048; size++ {
+			content := ContentLen(size, rs)
+			if actual := RecordsLen(content, rs); actual > size || actual < size-RecordOverhead {
+				t.Fatalf("Incorrect content length for size=%d rs=%d, got records length=%d", size, rs, actual)
+			}
+		}
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	for _, n := range []int{0, 16, 32, 64, 65, 100} {
+		ikm := make([]byte, n)
+		salt := make([]byte, SaltLen)
+		if _, err := rand.Read(ikm); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rand.Read(salt); err != nil {
+			t.Fatal(err)
+		}
+		expectedKey := make([]byte, KeyLen)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, contentEncryptionKeyInfo), expectedKey); err != nil {
+			t.Fatal(err)
+		}
+		expectedNonce := make([]byte, NonceLen)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, nonceInfo), expectedNonce); err != nil {
+			t.Fatal(err)
+		}
+		key, nonce, err := DeriveKeys(ikm, salt, make([]byte, KeyLen+NonceLen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, expectedKey) || !bytes.Equal(nonce, expectedNonce) {
+			t.Fatalf("Incorrect keys for ikm length %d", n)
+		}
+	}
+}
+
+func BenchmarkAppendEncrypt(b *testing.B) {
+	ikm := make([]byte, 32)
+	salt := make([]byte, SaltLen)
+	plaintext := bytes.Repeat([]byte("0123456789"), 100)
+	params := Params{Salt: salt, KeyID: make([]byte, 65)}
+	dst := make([]byte, 0, EncryptedLen(len(plaintext), params))
+	for b.Loop() {
+		_, err := AppendEncrypt(dst, ikm, plaintext, params)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package ece
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// hkdfCounter is the single block counter of HKDF-Expand, as all derived keys fit in one sha256 output.
+var hkdfCounter = []byte{1}
+
+// hmacSHA256 computes HMAC-SHA256 (RFC 2104) on a reused sha256 state.
+// The HMAC keys (the salt, then the pseudorandom key) change on every message, so crypto/hmac would allocate
+// its inner and outer states per message, while this state is pooled with the scratch.
+type hmacSHA256 struct {
+	h   hash.Hash
+	pad [sha256.BlockSize]byte
+}
+
+func newHMACSHA256() *hmacSHA256 {
+	return &hmacSHA256{h: sha256.New()}
+}
+
+// sum writes the HMAC of the message parts into dst, the key must not be longer than a sha256 block.
+func (m *hmacSHA256) sum(dst *[sha256.Size]byte, key []byte, parts ...[]byte) []byte {
+	clear(m.pad[:])
+	copy(m.pad[:], key)
+	for i := range m.pad {
+		m.pad[i] ^= 0x36
+	}
+	m.h.Reset()
+	m.h.Write(m.pad[:])
+	for _, part := range parts {
+		m.h.Write(part)
+	}
+	inner := m.h.Sum(dst[:0])
+	for i := range m.pad {
+		m.pad[i] ^= 0x36 ^ 0x5c
+	}
+	m.h.Reset()
+	m.h.Write(m.pad[:])
+	m.h.Write(inner)
+	return m.h.Sum(dst[:0])
+}
+
+// wipe clears the padded key and overwrites the last buffered input of the sha256 state, which is not cleared by Reset.
+func (m *hmacSHA256) wipe() {
+	clear(m.pad[:])
+	m.h.Reset()
+	m.h.Write(m.pad[:sha256.BlockSize-1])
+	m.h.Reset()
+}
+
+// deriveKeys derive the content encryption key and the nonce into dst, see [DeriveKeys].
+// Both keys share the same pseudorandom key, so HKDF-Extract is only done once.
+// The sum buffer holds the pseudorandom key then the HMAC outputs, it is cleared with the HMAC state before returning.
+func deriveKeys(ikm []byte, salt []byte, dst []byte, mac *hmacSHA256, sum *[sha256.Size]byte) (contentEncryptionKey, nonce []byte, err error) {
+	defer mac.wipe()
+	defer clear(sum[:])
+	var prk [sha256.Size]byte
+	defer clear(prk[:])
+	copy(prk[:], mac.sum(sum, salt, ikm))
+
+	contentEncryptionKey = dst[:KeyLen:KeyLen]
+	copy(contentEncryptionKey, mac.sum(sum, prk[:], contentEncryptionKeyInfo, hkdfCounter))
+	nonce = dst[KeyLen : KeyLen+NonceLen : KeyLen+NonceLen]
+	copy(nonce, mac.sum(sum, prk[:], nonceInfo, hkdfCounter))
+	return contentEncryptionKey, nonce, nil
+}
@@ -0,0 +1,40 @@
+package fwebpush
+
+// ContentEncoding is the content coding used to encrypt the push message payload.
+// Browsers advertise the supported values in PushManager.supportedContentEncodings.
+type ContentEncoding string
+
+const (
+	ContentEncodingUnset ContentEncoding = ""
+	// ContentEncodingAES128GCM is the RFC8188 content coding required by RFC8291 (default).
+	ContentEncodingAES128GCM ContentEncoding = "aes128gcm"
+	// ContentEncodingAESGCM is the legacy content coding from draft-ietf-webpush-encryption-04,
+	// for older user agents and push services that do not support aes128gcm.
+	// The salt and local public key are sent using the Encryption and Crypto-Key headers.
+	// Local secret caching is not supported for this encoding.
+	ContentEncodingAESGCM ContentEncoding = "aesgcm"
+)
+
+// Checking allowable values for the content encoding.
+func isValidContentEncoding(encoding ContentEncoding) bool {
+	switch encoding {
+	case ContentEncodingAES128GCM, ContentEncodingAESGCM:
+		return true
+	}
+	return false
+}
+
+// resolveContentEncoding returns the content encoding to use for a subscription.
+// Options take precedence over the Subscription, which take precedence over the pusher default.
+func (p *VAPIDPusher) resolveContentEncoding(subEncoding ContentEncoding, options Options) ContentEncoding {
+	if options.ContentEncoding != ContentEncodingUnset {
+		return options.ContentEncoding
+	}
+	if subEncoding != ContentEncodingUnset {
+		return subEncoding
+	}
+	if p.contentEncoding != ContentEncodingUnset {
+		return p.contentEncoding
+	}
+	return ContentEncodingAES128GCM
+}
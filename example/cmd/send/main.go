@@ -47,6 +47,7 @@ func main() {
 		keypair[0],
 		fwebpush.WithLocalSecretTTL(4*time.Hour),
 		fwebpush.WithRecordSize(1024),
+		fwebpush.WithPayloadCompression(),
 	)
 
 	if err != nil {
@@ -1,11 +1,29 @@
+// The payload is sent with fwebpush.WithPayloadCompression, prefixed by a 1 byte header:
+// 0 for an uncompressed payload, 1 for a raw deflate compressed payload.
+async function decodePayload(data) {
+  const bytes = new Uint8Array(await data.arrayBuffer());
+  switch (bytes[0]) {
+    case 0:
+      return new TextDecoder().decode(bytes.subarray(1));
+    case 1: {
+      const stream = new Blob([bytes.subarray(1)]).stream().pipeThrough(new DecompressionStream('deflate-raw'));
+      return new Response(stream).text();
+    }
+    default:
+      throw new Error(`unsupported compression ${bytes[0]}`);
+  }
+}
+
 self.addEventListener('push', event => {
   console.log('[Service Worker] Push Received.');
-  console.log(`[Service Worker] Push had this data: "${event.data.text()}"`);
 
-  const title = 'Test Webpush';
-  const options = {
-    body: event.data.text(),
-  };
+  event.waitUntil(decodePayload(event.data).then(text => {
+    console.log(`[Service Worker] Push had this data: "${text}"`);
 
-  event.waitUntil(self.registration.showNotification(title, options));
+    const title = 'Test Webpush';
+    const options = {
+      body: text,
+    };
+    return self.registration.showNotification(title, options);
+  }));
 });
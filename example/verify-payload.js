@@ -0,0 +1,39 @@
+// Verify a payload signed by fwebpush.PayloadSigner in the service worker.
+//
+// Envelope (integers are big endian):
+//   version (1) | algorithm (1) | timestamp, unix ms (8) | key ID length (1) | key ID | payload | signature (64)
+// The signature covers everything before it.
+//
+// keys maps each key ID to {algorithm, key}, where algorithm is 1 (Ed25519) or 2 (ES256),
+// and key is a CryptoKey imported for "verify", for example:
+//   crypto.subtle.importKey('raw', ed25519PublicKey, {name: 'Ed25519'}, false, ['verify'])
+//   crypto.subtle.importKey('raw', p256PublicKey, {name: 'ECDSA', namedCurve: 'P-256'}, false, ['verify'])
+async function verifySignedPayload(envelope, keys, maxAgeMs) {
+  const data = new Uint8Array(envelope);
+  const headerLen = 11;
+  const signLen = 64;
+  if (data.length < headerLen + signLen || data[0] !== 1) {
+    throw new Error('invalid envelope');
+  }
+  const algorithm = data[1];
+  const timestamp = Number(new DataView(data.buffer, data.byteOffset + 2, 8).getBigUint64(0));
+  const keyIdLen = data[10];
+  const signedLen = data.length - signLen;
+  if (headerLen + keyIdLen > signedLen) {
+    throw new Error('invalid envelope');
+  }
+  const keyId = new TextDecoder().decode(data.subarray(headerLen, headerLen + keyIdLen));
+  const entry = keys[keyId];
+  if (!entry || entry.algorithm !== algorithm) {
+    throw new Error(`unknown key ${keyId}`);
+  }
+  const params = algorithm === 1 ? {name: 'Ed25519'} : {name: 'ECDSA', hash: 'SHA-256'};
+  const valid = await crypto.subtle.verify(params, entry.key, data.subarray(signedLen), data.subarray(0, signedLen));
+  if (!valid) {
+    throw new Error('invalid signature');
+  }
+  if (maxAgeMs && Date.now() - timestamp > maxAgeMs) {
+    throw new Error('expired payload');
+  }
+  return {keyId, timestamp: new Date(timestamp), payload: data.subarray(headerLen + keyIdLen, signedLen)};
+}
@@ -0,0 +1,70 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+)
+
+// NewSignerEdDSA returns a new ed25519-based signer.
+func NewSignerEdDSA(key ed25519.PrivateKey) (*EdDSAAlg, error) {
+	if len(key) == 0 {
+		return nil, ErrNilKey
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidKey
+	}
+	return &EdDSAAlg{
+		alg:        EdDSA,
+		privateKey: key,
+	}, nil
+}
+
+// NewVerifierEdDSA returns a new ed25519-based verifier.
+func NewVerifierEdDSA(key ed25519.PublicKey) (*EdDSAAlg, error) {
+	if len(key) == 0 {
+		return nil, ErrNilKey
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+	return &EdDSAAlg{
+		alg:       EdDSA,
+		publicKey: key,
+	}, nil
+}
+
+type EdDSAAlg struct {
+	alg        Algorithm
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func (ed *EdDSAAlg) Algorithm() Algorithm {
+	return ed.alg
+}
+
+func (ed *EdDSAAlg) SignSize() int {
+	return ed25519.SignatureSize
+}
+
+func (ed *EdDSAAlg) Sign(payload []byte) ([]byte, error) {
+	return ed25519.Sign(ed.privateKey, payload), nil
+}
+
+func (ed *EdDSAAlg) Verify(token *Token) error {
+	switch {
+	case !token.isValid():
+		return ErrUninitializedToken
+	case !constTimeAlgEqual(token.Header().Algorithm, ed.alg):
+		return ErrAlgorithmMismatch
+	default:
+		return ed.VerifySignature(token.PayloadPart(), token.Signature())
+	}
+}
+
+// VerifySignature verifies the raw signature of the payload.
+func (ed *EdDSAAlg) VerifySignature(payload, signature []byte) error {
+	if !ed25519.Verify(ed.publicKey, payload, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
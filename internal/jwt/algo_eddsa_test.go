@@ -0,0 +1,58 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestEdDSA(t *testing.T) {
+	testCases := []struct {
+		privateKey ed25519.PrivateKey
+		publicKey  ed25519.PublicKey
+		wantErr    error
+	}{
+		{ed25519PrivateKey, ed25519PublicKey, nil},
+		{ed25519PrivateKey, ed25519PublicKeyAnother, ErrInvalidSignature},
+		{ed25519PrivateKeyAnother, ed25519PublicKey, ErrInvalidSignature},
+	}
+
+	for _, tc := range testCases {
+		signer, err := NewSignerEdDSA(tc.privateKey)
+		mustOk(t, err)
+
+		verifier, err := NewVerifierEdDSA(tc.publicKey)
+		mustOk(t, err)
+
+		token, err := NewBuilder(signer).Build(simplePayload)
+		mustOk(t, err)
+
+		err = verifier.Verify(token)
+		mustEqual(t, err, tc.wantErr)
+
+		err = verifier.VerifySignature(token.PayloadPart(), token.Signature())
+		mustEqual(t, err, tc.wantErr)
+	}
+}
+
+func TestEdDSA_BadKeys(t *testing.T) {
+	testCases := []struct {
+		err     error
+		wantErr error
+	}{
+		{getErr(NewSignerEdDSA(nil)), ErrNilKey},
+		{getErr(NewSignerEdDSA(ed25519.PrivateKey(ed25519PublicKey))), ErrInvalidKey},
+		{getErr(NewVerifierEdDSA(nil)), ErrNilKey},
+		{getErr(NewVerifierEdDSA(ed25519.PublicKey(ed25519PrivateKey))), ErrInvalidKey},
+	}
+
+	for _, tc := range testCases {
+		mustEqual(t, tc.err, tc.wantErr)
+	}
+}
+
+var (
+	ed25519PrivateKey        = ed25519.NewKeyFromSeed([]byte("00000000000000000000000000000000"))
+	ed25519PublicKey         = ed25519PrivateKey.Public().(ed25519.PublicKey)
+	ed25519PrivateKeyAnother = ed25519.NewKeyFromSeed([]byte("11111111111111111111111111111111"))
+	ed25519PublicKeyAnother  = ed25519PrivateKeyAnother.Public().(ed25519.PublicKey)
+)
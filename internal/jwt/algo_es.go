@@ -4,11 +4,19 @@
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"encoding/asn1"
+	"io"
 	"math/big"
 )
 
 // NewSignerES returns a new ECDSA-based signer.
 func NewSignerES(alg Algorithm, key *ecdsa.PrivateKey) (*ESAlg, error) {
+	return NewSignerESRand(alg, key, rand.Reader)
+}
+
+// NewSignerESRand returns a new ECDSA-based signer using the provided random source.
+// If random is nil, the signer produces deterministic signatures according to RFC 6979.
+func NewSignerESRand(alg Algorithm, key *ecdsa.PrivateKey, random io.Reader) (*ESAlg, error) {
 	if key == nil {
 		return nil, ErrNilKey
 	}
@@ -22,6 +30,7 @@ func NewSignerES(alg Algorithm, key *ecdsa.PrivateKey) (*ESAlg, error) {
 		privateKey: key,
 		publicKey:  nil,
 		signSize:   roundBytes(key.PublicKey.Params().BitSize) * 2,
+		random:     random,
 	}, nil
 }
 
@@ -70,6 +79,7 @@ type ESAlg struct {
 	publicKey  *ecdsa.PublicKey
 	privateKey *ecdsa.PrivateKey
 	signSize   int
+	random     io.Reader
 }
 
 func (es *ESAlg) Algorithm() Algorithm {
@@ -86,7 +96,7 @@ func (es *ESAlg) Sign(payload []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	r, s, err := ecdsa.Sign(rand.Reader, es.privateKey, digest)
+	r, s, err := es.sign(digest)
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +110,24 @@ func (es *ESAlg) Sign(payload []byte) ([]byte, error) {
 	return signature, nil
 }
 
+func (es *ESAlg) sign(digest []byte) (*big.Int, *big.Int, error) {
+	if es.random != nil {
+		return ecdsa.Sign(es.random, es.privateKey, digest)
+	}
+	// Deterministic RFC 6979 signature.
+	der, err := es.privateKey.Sign(nil, digest, es.hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, nil, err
+	}
+	return sig.R, sig.S, nil
+}
+
 func (es *ESAlg) Verify(token *Token) error {
 	switch {
 	case !token.isValid():
@@ -107,11 +135,12 @@ func (es *ESAlg) Verify(token *Token) error {
 	case !constTimeAlgEqual(token.Header().Algorithm, es.alg):
 		return ErrAlgorithmMismatch
 	default:
-		return es.verify(token.PayloadPart(), token.Signature())
+		return es.VerifySignature(token.PayloadPart(), token.Signature())
 	}
 }
 
-func (es *ESAlg) verify(payload, signature []byte) error {
+// VerifySignature verifies the raw signature (r || s) of the payload.
+func (es *ESAlg) VerifySignature(payload, signature []byte) error {
 	if len(signature) != es.SignSize() {
 		return ErrInvalidSignature
 	}
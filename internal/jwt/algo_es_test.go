@@ -145,3 +145,18 @@ func TestES_BadKeys(t *testing.T) {
 MvbD7c0RONrhLoch5W6TlWCMj9f4EkQQEfk63Q8F
 -----END EC PRIVATE KEY-----`
 )
+
+func TestES_Deterministic(t *testing.T) {
+	signer, err := NewSignerESRand(ES256, ecdsaPrivateKey256, nil)
+	mustOk(t, err)
+	verifier, err := NewVerifierES(ES256, ecdsaPublicKey256)
+	mustOk(t, err)
+
+	token, err := NewBuilder(signer).Build(simplePayload)
+	mustOk(t, err)
+	mustOk(t, verifier.Verify(token))
+
+	another, err := NewBuilder(signer).Build(simplePayload)
+	mustOk(t, err)
+	mustEqual(t, token.String(), another.String())
+}
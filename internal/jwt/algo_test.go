@@ -14,6 +14,7 @@ func TestSignerAlg(t *testing.T) {
 		{must(NewSignerES(ES256, ecdsaPrivateKey256)), ES256},
 		{must(NewSignerES(ES384, ecdsaPrivateKey384)), ES384},
 		{must(NewSignerES(ES512, ecdsaPrivateKey521)), ES512},
+		{must(NewSignerEdDSA(ed25519PrivateKey)), EdDSA},
 	}
 
 	for _, tc := range testCases {
@@ -29,6 +30,7 @@ func TestVerifierAlg(t *testing.T) {
 		{must(NewVerifierES(ES256, ecdsaPublicKey256)), ES256},
 		{must(NewVerifierES(ES384, ecdsaPublicKey384)), ES384},
 		{must(NewVerifierES(ES512, ecdsaPublicKey521)), ES512},
+		{must(NewVerifierEdDSA(ed25519PublicKey)), EdDSA},
 	}
 
 	for _, tc := range testCases {
@@ -0,0 +1,138 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+)
+
+// LocalKey format versions, see [LocalKey.FormatVersion].
+const (
+	// LocalKeyVersionSecret is the deprecated format caching the local secret (LocalKey.Secret).
+	LocalKeyVersionSecret = 1
+	// LocalKeyVersionIKM is the format caching the IKM, in cleartext or sealed.
+	LocalKeyVersionIKM = 2
+	// LocalKeyVersion is the current format, set on the generated LocalKey.
+	LocalKeyVersion = LocalKeyVersionIKM
+)
+
+var ErrUnsupportedLocalKey = errors.New("unsupported local key")
+
+// FormatVersion returns the format version of the local key.
+// Local keys created before versioning are detected by their fields.
+func (k *LocalKey) FormatVersion() int {
+	switch {
+	case k.Version != 0:
+		return k.Version
+	case k.IKM != "" || k.SealedIKM != "":
+		return LocalKeyVersionIKM
+	case k.Secret != "":
+		return LocalKeyVersionSecret
+	}
+	return LocalKeyVersion
+}
+
+// hasIKM returns whether the local key has a cleartext or sealed ikm, which can be reused.
+func (k *LocalKey) hasIKM() bool {
+	return k != nil && k.FormatVersion() == LocalKeyVersionIKM && (k.IKM != "" || k.SealedIKM != "")
+}
+
+// MigrateLocalKey upgrades the LocalKey of the subscription to the current format, keeping its creation time,
+// so it can still be reused until it expires.
+// The LocalKey is returned as is if already in the current format, and nil is returned if the subscription has none.
+//
+// The deprecated Secret is either the ECDH shared secret or the local private key,
+// from which the IKM is derived using the subscription keys. The returned IKM is in cleartext,
+// use [LocalKeyRing.Seal] to seal it.
+func MigrateLocalKey(sub Subscription) (*LocalKey, error) {
+	lk := sub.LocalKey
+	if lk == nil {
+		return nil, nil
+	}
+	switch lk.FormatVersion() {
+	case LocalKeyVersionIKM:
+		return lk, nil
+	case LocalKeyVersionSecret:
+	default:
+		return nil, fmt.Errorf("version %d %w", lk.FormatVersion(), ErrUnsupportedLocalKey)
+	}
+
+	var ps ParsedSubscription
+	if err := ps.parseKeys(sub.Keys); err != nil {
+		return nil, errors.Join(ErrInvalidSubscription, err)
+	}
+	var public [localPublicKeyLen]byte
+	if err := decodeBase64Buff(lk.Public, public[:]); err != nil {
+		return nil, fmt.Errorf("invalid public key %w", ErrUnsupportedLocalKey)
+	}
+	var secret [sharedECDHSecretLen]byte
+	if err := decodeBase64Buff(lk.Secret, secret[:]); err != nil {
+		return nil, fmt.Errorf("invalid secret %w", ErrUnsupportedLocalKey)
+	}
+	sharedECDHSecret := secret[:]
+	// The secret is the private key if it matches the public key.
+	if privateKey, err := ecdh.P256().NewPrivateKey(secret[:]); err == nil && bytes.Equal(privateKey.PublicKey().Bytes(), public[:]) {
+		sharedECDHSecret, err = privateKey.ECDH(ps.publicKey)
+		if err != nil {
+			return nil, errors.Join(ErrEncryption, err)
+		}
+	}
+
+	prkInfo := make([]byte, 0, webPushInfoLen+p256dhLen+localPublicKeyLen)
+	prkInfo = append(prkInfo, webpushInfo...)
+	prkInfo = append(prkInfo, ps.p256dh[:]...)
+	prkInfo = append(prkInfo, public[:]...)
+	ikm, err := getHKDFKey(hkdf.New(sha256.New, sharedECDHSecret, ps.auth[:], prkInfo), make([]byte, 32))
+	if err != nil {
+		return nil, errors.Join(ErrEncryption, err)
+	}
+	return &LocalKey{
+		Version: LocalKeyVersion,
+		Public:  lk.Public,
+		IKM:     encodeBase64String(ikm),
+		At:      lk.At,
+	}, nil
+}
+
+// LocalKeyMigrationFailure is a subscription which LocalKey could not be migrated.
+type LocalKeyMigrationFailure struct {
+	// Index of the subscription.
+	Index    int
+	Endpoint string
+	Err      error
+}
+
+// LocalKeyMigrationReport is the result of [MigrateLocalKeys].
+type LocalKeyMigrationReport struct {
+	// Migrated is the number of upgraded LocalKey.
+	Migrated int
+	// Failed are the subscriptions which LocalKey could not be migrated, and were left unchanged.
+	Failed []LocalKeyMigrationFailure
+}
+
+// MigrateLocalKeys upgrades the LocalKey of every subscription to the current format in place,
+// see [MigrateLocalKey]. The subscriptions already in the current format or without LocalKey are skipped.
+func MigrateLocalKeys(subs []Subscription) LocalKeyMigrationReport {
+	var report LocalKeyMigrationReport
+	for i := range subs {
+		lk := subs[i].LocalKey
+		if lk == nil || lk.FormatVersion() == LocalKeyVersion {
+			continue
+		}
+		migrated, err := MigrateLocalKey(subs[i])
+		if err != nil {
+			report.Failed = append(report.Failed, LocalKeyMigrationFailure{
+				Index:    i,
+				Endpoint: subs[i].Endpoint,
+				Err:      err,
+			})
+			continue
+		}
+		subs[i].LocalKey = migrated
+		report.Migrated++
+	}
+	return report
+}
@@ -0,0 +1,155 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestLegacyLocalKey creates a local key in the deprecated Secret format.
+func newTestLegacyLocalKey(t testing.TB, sub Subscription, privateKeySecret bool) *LocalKey {
+	localPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := localPrivateKey.Bytes()
+	if !privateKeySecret {
+		parsed, err := ParseSubscription(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err = localPrivateKey.ECDH(parsed.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &LocalKey{
+		Public: encodeBase64String(localPrivateKey.PublicKey().Bytes()),
+		Secret: encodeBase64String(secret),
+		At:     time.Now().Add(-time.Minute).UnixMilli(),
+	}
+}
+
+func TestLocalKeyFormatVersion(t *testing.T) {
+	cases := []struct {
+		name     string
+		key      LocalKey
+		expected int
+	}{
+		{"secret", LocalKey{Public: "p", Secret: "s"}, LocalKeyVersionSecret},
+		{"ikm", LocalKey{Public: "p", IKM: "m"}, LocalKeyVersionIKM},
+		{"sealed", LocalKey{Public: "p", SealedIKM: "m", KeyID: "k"}, LocalKeyVersionIKM},
+		{"versioned", LocalKey{Version: 3, Public: "p", IKM: "m"}, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if v := c.key.FormatVersion(); v != c.expected {
+				t.Fatalf("Incorrect version, expected=%d, got=%d", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestMigrateLocalKey(t *testing.T) {
+	for _, privateKeySecret := range []bool{false, true} {
+		name := "shared secret"
+		if privateKeySecret {
+			name = "private key"
+		}
+		t.Run(name, func(t *testing.T) {
+			sub, privateKey, authSecret := newTestReceiver(t)
+			legacy := newTestLegacyLocalKey(t, sub, privateKeySecret)
+			sub.LocalKey = legacy
+			migrated, err := MigrateLocalKey(sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if migrated.Version != LocalKeyVersion || migrated.Public != legacy.Public || migrated.At != legacy.At || migrated.Secret != "" {
+				t.Fatalf("Incorrect migrated key %+v", migrated)
+			}
+			if again, err := MigrateLocalKey(Subscription{LocalKey: migrated}); err != nil || again != migrated {
+				t.Fatalf("Expected the migrated key to be returned as is, got=%+v, err=%v", again, err)
+			}
+
+			// The migrated key is reused.
+			sub.LocalKey = migrated
+			p := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+			msg, err := p.EncryptNotification(message, &sub, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.LocalKey != nil {
+				t.Fatal("Expected the local key to be reused")
+			}
+			if !bytes.Equal(msg.Body[localPublicKeyOffset:dataOffset], mustDecodeBase64(t, legacy.Public)) {
+				t.Fatal("Incorrect local public key")
+			}
+			plaintext, err := DecryptNotification(msg.Body, privateKey, authSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, message) {
+				t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+			}
+		})
+	}
+}
+
+func TestMigrateLocalKeys(t *testing.T) {
+	var subs []Subscription
+	for range 6 {
+		sub, _, _ := newTestReceiver(t)
+		subs = append(subs, sub)
+	}
+	subs[0].LocalKey = newTestLegacyLocalKey(t, subs[0], false)
+	subs[1].LocalKey = newTestLegacyLocalKey(t, subs[1], true)
+	current := newTestLocalKey(t)
+	subs[2].LocalKey = current
+	// subs[3] has no local key.
+	invalid := &LocalKey{Public: "invalid", Secret: "invalid"}
+	subs[4].LocalKey = invalid
+	future := &LocalKey{Version: LocalKeyVersion + 1, Public: "p", IKM: "m"}
+	subs[5].LocalKey = future
+
+	report := MigrateLocalKeys(subs)
+	if report.Migrated != 2 {
+		t.Fatalf("Incorrect migrated count, expected=2, got=%d", report.Migrated)
+	}
+	for _, sub := range subs[:2] {
+		if sub.LocalKey.FormatVersion() != LocalKeyVersion {
+			t.Fatalf("Expected the local key to be migrated, got=%+v", sub.LocalKey)
+		}
+	}
+	if subs[2].LocalKey != current || subs[3].LocalKey != nil || subs[4].LocalKey != invalid || subs[5].LocalKey != future {
+		t.Fatal("Expected the other local keys to be unchanged")
+	}
+	if len(report.Failed) != 2 || report.Failed[0].Index != 4 || report.Failed[1].Index != 5 {
+		t.Fatalf("Incorrect failures %+v", report.Failed)
+	}
+	if report.Failed[0].Endpoint != subs[4].Endpoint || !errors.Is(report.Failed[1].Err, ErrUnsupportedLocalKey) {
+		t.Fatalf("Incorrect failures %+v", report.Failed)
+	}
+}
+
+// Local keys of an unsupported version are replaced.
+func TestUnsupportedLocalKeyVersion(t *testing.T) {
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+	sub, _, _ := newTestReceiver(t)
+	msg, err := p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := *msg.LocalKey
+	future.Version = LocalKeyVersion + 1
+	sub.LocalKey = &future
+	msg, err = p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.LocalKey == nil || msg.LocalKey.Version != LocalKeyVersion {
+		t.Fatalf("Expected a new local key, got=%+v", msg.LocalKey)
+	}
+}
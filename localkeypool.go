@@ -0,0 +1,103 @@
+package fwebpush
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LocalKeyPool is a bounded pool of pre-generated local (application server) key pairs,
+// kept filled by a background goroutine, which takes the key generation off the sending path
+// when the local key pair is rotated often (see [WithPerMessageLocalKey]).
+//
+// Each key pair is only used once. The pusher falls back to generating the key pair when the pool is empty.
+// See [WithLocalKeyPool].
+type LocalKeyPool struct {
+	keys           chan *ecdh.PrivateKey
+	refillInterval time.Duration
+	misses         atomic.Int64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLocalKeyPool creates a pool holding up to size key pairs, and starts filling it.
+// The refillInterval is the minimum delay between two generated key pairs, 0 to generate as fast as possible.
+// The pool must be closed to stop the background goroutine.
+func NewLocalKeyPool(size int, refillInterval time.Duration) *LocalKeyPool {
+	p := &LocalKeyPool{
+		keys:           make(chan *ecdh.PrivateKey, max(size, 1)),
+		refillInterval: refillInterval,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+func (p *LocalKeyPool) fill() {
+	defer close(p.done)
+	var ticker *time.Ticker
+	if p.refillInterval > 0 {
+		ticker = time.NewTicker(p.refillInterval)
+		defer ticker.Stop()
+	}
+	curve := ecdh.P256()
+	for {
+		key, err := curve.GenerateKey(rand.Reader)
+		if err == nil {
+			// Blocks while the pool is full.
+			select {
+			case p.keys <- key:
+			case <-p.stop:
+				return
+			}
+		}
+		if ticker != nil {
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}
+}
+
+// get returns a pre-generated key pair, or nil if the pool is empty.
+func (p *LocalKeyPool) get() *ecdh.PrivateKey {
+	select {
+	case key := <-p.keys:
+		return key
+	default:
+		p.misses.Add(1)
+		return nil
+	}
+}
+
+// Len returns the number of available key pairs.
+func (p *LocalKeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Misses returns the number of times the pool was empty, useful for tuning its size and refill interval.
+func (p *LocalKeyPool) Misses() int64 {
+	return p.misses.Load()
+}
+
+// Close stops filling the pool and discards the remaining key pairs.
+func (p *LocalKeyPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+		for {
+			select {
+			case <-p.keys:
+			default:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package fwebpush
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func waitLocalKeyPool(t testing.TB, pool *LocalKeyPool, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool not filled, expected=%d, got=%d", n, pool.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLocalKeyPool(t *testing.T) {
+	pool := NewLocalKeyPool(4, 0)
+	waitLocalKeyPool(t, pool, 4)
+	// Bounded.
+	time.Sleep(10 * time.Millisecond)
+	if pool.Len() != 4 {
+		t.Fatalf("Incorrect len, expected=4, got=%d", pool.Len())
+	}
+	pool.Close()
+	pool.Close()
+	if pool.Len() != 0 {
+		t.Fatalf("Expected the pool to be drained, got=%d", pool.Len())
+	}
+	if pool.get() != nil {
+		t.Fatal("Expected no key from a closed pool")
+	}
+}
+
+func TestLocalKeyPoolPusher(t *testing.T) {
+	// A single key is generated before waiting for the refill interval.
+	pool := NewLocalKeyPool(4, time.Hour)
+	defer pool.Close()
+	waitLocalKeyPool(t, pool, 1)
+	p := newTestPusher(t, WithPerMessageLocalKey(), WithLocalKeyPool(pool))
+	sub, privateKey, authSecret := newTestReceiver(t)
+
+	var keyIDs [][]byte
+	for range 2 {
+		body := readRequestBody(t, p, message, &sub, Options{})
+		plaintext, err := DecryptNotification(body, privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+		}
+		keyIDs = append(keyIDs, body[localPublicKeyOffset:dataOffset])
+	}
+	// The second message falls back to generating the key pair.
+	if pool.Len() != 0 || pool.Misses() != 1 {
+		t.Fatalf("Incorrect pool usage, len=%d, misses=%d", pool.Len(), pool.Misses())
+	}
+	if bytes.Equal(keyIDs[0], keyIDs[1]) {
+		t.Fatal("Expected a new local key pair per message")
+	}
+}
@@ -0,0 +1,163 @@
+package fwebpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	kekNonceLen  = 12
+	sealedIKMLen = kekNonceLen + 32 + gcmTagLen
+
+	localKeyAADLen = localPublicKeyLen + 8
+	kekBufLen      = sealedIKMLen + localKeyAADLen + 32
+)
+
+var ErrLocalKeySealed = errors.New("local key sealed with unknown key")
+
+// LocalKeyRing seals the IKM of the [LocalKey] with AES-GCM key-encryption keys (KEK), identified by a key ID,
+// so the IKM is never persisted in cleartext.
+// New keys are sealed with the primary KEK, while the other KEKs are only used for opening,
+// which allows rotating the KEK without invalidating the persisted keys.
+//
+// It is immutable and safe for concurrent use. See [WithLocalKeyRing].
+type LocalKeyRing struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewLocalKeyRing creates a key ring from the KEKs by key ID, each KEK must be 16, 24 or 32 bytes.
+// The primary key ID must exist in the keys.
+func NewLocalKeyRing(primaryID string, keys map[string][]byte) (*LocalKeyRing, error) {
+	if _, ok := keys[primaryID]; !ok {
+		return nil, fmt.Errorf("primary key %q not found", primaryID)
+	}
+	r := &LocalKeyRing{
+		primary: primaryID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" {
+			return nil, errors.New("empty key ID")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		r.aeads[id] = gcm
+	}
+	return r, nil
+}
+
+// PrimaryID returns the ID of the KEK used for sealing.
+func (r *LocalKeyRing) PrimaryID() string {
+	return r.primary
+}
+
+// Seal returns a copy of the local key with the IKM sealed by the primary KEK.
+// The local key is resealed if it is sealed by another KEK, and returned as is if sealed by the primary KEK.
+func (r *LocalKeyRing) Seal(localKey *LocalKey) (*LocalKey, error) {
+	if localKey.KeyID == r.primary && localKey.SealedIKM != "" {
+		return localKey, nil
+	}
+	var k parsedLocalKey
+	if err := k.parse(localKey); err != nil {
+		return nil, err
+	}
+	if err := r.open(&k); err != nil {
+		return nil, err
+	}
+	return r.seal(k.public[:], k.ikm[:], k.at, rand.Reader)
+}
+
+// Open returns a copy of the local key with the IKM in cleartext.
+// The local key is returned as is if not sealed.
+func (r *LocalKeyRing) Open(localKey *LocalKey) (*LocalKey, error) {
+	if localKey.SealedIKM == "" {
+		return localKey, nil
+	}
+	var k parsedLocalKey
+	if err := k.parse(localKey); err != nil {
+		return nil, err
+	}
+	if err := r.open(&k); err != nil {
+		return nil, err
+	}
+	return &LocalKey{
+		Version: LocalKeyVersion,
+		Public:  localKey.Public,
+		IKM:     encodeBase64String(k.ikm[:]),
+		At:      k.at,
+	}, nil
+}
+
+// seal creates a local key with the ikm sealed by the primary KEK.
+func (r *LocalKeyRing) seal(public []byte, ikm []byte, at int64, rand io.Reader) (*LocalKey, error) {
+	var sealed [sealedIKMLen]byte
+	nonce := sealed[:kekNonceLen]
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return nil, err
+	}
+	aad := appendLocalKeyAAD(make([]byte, 0, localKeyAADLen), public, at)
+	r.aeads[r.primary].Seal(sealed[kekNonceLen:kekNonceLen], nonce, ikm, aad)
+	return &LocalKey{
+		Version:   LocalKeyVersion,
+		Public:    encodeBase64String(public),
+		KeyID:     r.primary,
+		SealedIKM: encodeBase64String(sealed[:]),
+		At:        at,
+	}, nil
+}
+
+// open decrypts the sealed ikm of the local key in place, does nothing if not sealed.
+func (r *LocalKeyRing) open(k *parsedLocalKey) error {
+	if !k.sealed {
+		return nil
+	}
+	gcm, ok := r.aeads[k.keyID]
+	if !ok {
+		return fmt.Errorf("key %q %w", k.keyID, ErrLocalKeySealed)
+	}
+	// Work in a pooled buffer, so k does not escape through the cipher interface.
+	pooledKeyBuf := getKeyBuf()
+	defer putKeyBuf(pooledKeyBuf)
+	buf := pooledKeyBuf[:kekBufLen]
+	defer clear(buf)
+	sealed := buf[:sealedIKMLen:sealedIKMLen]
+	copy(sealed, k.sealedIKM[:])
+	aad := appendLocalKeyAAD(buf[sealedIKMLen:sealedIKMLen:sealedIKMLen+localKeyAADLen], k.public[:], k.at)
+	ikm, err := gcm.Open(buf[sealedIKMLen+localKeyAADLen:sealedIKMLen+localKeyAADLen], sealed[:kekNonceLen], sealed[kekNonceLen:], aad)
+	if err != nil {
+		return fmt.Errorf("error opening local key: %w", err)
+	}
+	copy(k.ikm[:], ikm)
+	k.sealed = false
+	k.sealedIKM = [sealedIKMLen]byte{}
+	return nil
+}
+
+// appendLocalKeyAAD appends the additional data binding the sealed ikm to the local public key and creation time.
+func appendLocalKeyAAD(dst []byte, public []byte, at int64) []byte {
+	dst = append(dst, public...)
+	return binary.BigEndian.AppendUint64(dst, uint64(at))
+}
+
+// openLocalKey opens the local key using the key ring of the pusher.
+func (p *VAPIDPusher) openLocalKey(k *parsedLocalKey) error {
+	if !k.sealed {
+		return nil
+	}
+	if p.localKeyRing == nil {
+		return fmt.Errorf("no key ring configured %w", ErrLocalKeySealed)
+	}
+	return p.localKeyRing.open(k)
+}
@@ -0,0 +1,187 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeyRing(t testing.TB, primaryID string, ids ...string) *LocalKeyRing {
+	keys := make(map[string][]byte)
+	for _, id := range append(ids, primaryID) {
+		// Derive the key from the id, so rings sharing an id share the key.
+		keys[id] = bytes.Repeat([]byte(id), 32)[:32]
+	}
+	ring, err := NewLocalKeyRing(primaryID, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func newTestLocalKey(t testing.TB) *LocalKey {
+	public := make([]byte, localPublicKeyLen)
+	ikm := make([]byte, 32)
+	_, _ = rand.Read(public)
+	_, _ = rand.Read(ikm)
+	return &LocalKey{
+		Version: LocalKeyVersion,
+		Public:  encodeBase64String(public),
+		IKM:     encodeBase64String(ikm),
+		At:      time.Now().UnixMilli(),
+	}
+}
+
+func TestLocalKeyRing(t *testing.T) {
+	ring := newTestKeyRing(t, "a")
+	localKey := newTestLocalKey(t)
+	sealed, err := ring.Seal(localKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.IKM != "" || sealed.SealedIKM == "" || sealed.KeyID != "a" {
+		t.Fatalf("Incorrect sealed key %+v", sealed)
+	}
+	b, err := json.Marshal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), localKey.IKM) || strings.Contains(string(b), `"m"`) {
+		t.Fatalf("Expected the ikm to not be serialized: %s", b)
+	}
+	if again, err := ring.Seal(sealed); err != nil || again != sealed {
+		t.Fatalf("Expected the sealed key to be returned as is, got=%+v, err=%v", again, err)
+	}
+
+	opened, err := ring.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *opened != *localKey {
+		t.Fatalf("Incorrect opened key, expected=%+v, got=%+v", localKey, opened)
+	}
+
+	// The sealed ikm is bound to the public key and creation time.
+	tampered := *sealed
+	tampered.At++
+	if _, err := ring.Open(&tampered); err == nil {
+		t.Fatal("Expected error opening tampered key")
+	}
+	unknown := *sealed
+	unknown.KeyID = "unknown"
+	if _, err := ring.Open(&unknown); !errors.Is(err, ErrLocalKeySealed) {
+		t.Fatalf("Expected ErrLocalKeySealed, got=%v", err)
+	}
+}
+
+func TestLocalKeyRingRotation(t *testing.T) {
+	localKey := newTestLocalKey(t)
+	sealed, err := newTestKeyRing(t, "a").Seal(localKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestKeyRing(t, "b", "a")
+	if opened, err := rotated.Open(sealed); err != nil || *opened != *localKey {
+		t.Fatalf("Incorrect opened key, expected=%+v, got=%+v, err=%v", localKey, opened, err)
+	}
+	resealed, err := rotated.Seal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed.KeyID != "b" {
+		t.Fatalf("Incorrect key ID, expected=b, got=%s", resealed.KeyID)
+	}
+
+	// The old key can be removed once every local key is resealed.
+	retired := newTestKeyRing(t, "b")
+	if opened, err := retired.Open(resealed); err != nil || *opened != *localKey {
+		t.Fatalf("Incorrect opened key, expected=%+v, got=%+v, err=%v", localKey, opened, err)
+	}
+	if _, err := retired.Open(sealed); !errors.Is(err, ErrLocalKeySealed) {
+		t.Fatalf("Expected ErrLocalKeySealed, got=%v", err)
+	}
+}
+
+func TestNewLocalKeyRingInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		primary string
+		keys    map[string][]byte
+	}{
+		{"missing primary", "a", map[string][]byte{"b": make([]byte, 32)}},
+		{"empty id", "a", map[string][]byte{"a": make([]byte, 32), "": make([]byte, 32)}},
+		{"key size", "a", map[string][]byte{"a": make([]byte, 10)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewLocalKeyRing(c.primary, c.keys); err == nil {
+				t.Fatal("Expected error")
+			}
+		})
+	}
+}
+
+func TestLocalKeyRingPusher(t *testing.T) {
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour), WithLocalKeyRing(newTestKeyRing(t, "a")))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	first := readRequestBody(t, p, message, &sub, Options{})
+	if sub.LocalKey == nil || sub.LocalKey.IKM != "" || sub.LocalKey.SealedIKM == "" {
+		t.Fatalf("Expected a sealed local key, got=%+v", sub.LocalKey)
+	}
+
+	// The sealed key is opened by the rotated ring, for both subscription types.
+	rotated := newTestPusher(t, WithLocalSecretTTL(time.Hour), WithLocalKeyRing(newTestKeyRing(t, "b", "a")))
+	second := readRequestBody(t, rotated, message, &sub, Options{})
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, _, err := rotated.AppendEncryptedParsed(nil, message, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range [][]byte{second, third} {
+		if !bytes.Equal(body[localPublicKeyOffset:dataOffset], first[localPublicKeyOffset:dataOffset]) {
+			t.Fatal("Expected the local key to be reused")
+		}
+		plaintext, err := DecryptNotification(body, privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+		}
+	}
+
+	// The sealed key cannot be used without the key ring.
+	plain := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+	if _, err := plain.EncryptNotification(message, &sub, Options{}); !errors.Is(err, ErrLocalKeySealed) {
+		t.Fatalf("Expected ErrLocalKeySealed, got=%v", err)
+	}
+	if _, _, err := plain.AppendEncryptedParsed(nil, message, parsed, Options{}); !errors.Is(err, ErrLocalKeySealed) {
+		t.Fatalf("Expected ErrLocalKeySealed, got=%v", err)
+	}
+}
+
+func TestLocalKeyRingStore(t *testing.T) {
+	store := NewMemoryLocalKeyStore(10)
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour), WithLocalKeyStore(store), WithLocalKeyRing(newTestKeyRing(t, "a")))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	first := readRequestBody(t, p, message, &sub, Options{})
+	stored, _ := store.Load(sub.Endpoint)
+	if stored == nil || stored.IKM != "" || stored.SealedIKM == "" {
+		t.Fatalf("Expected a sealed local key, got=%+v", stored)
+	}
+	second := readRequestBody(t, p, message, &sub, Options{})
+	if !bytes.Equal(second[localPublicKeyOffset:dataOffset], first[localPublicKeyOffset:dataOffset]) {
+		t.Fatal("Expected the local key to be reused")
+	}
+	if _, err := DecryptNotification(second, privateKey, authSecret); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,305 @@
+package fwebpush
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LocalKeyStore stores the local keys generated by the local secret caching, keyed by subscription endpoint,
+// so that callers do not have to save the LocalKey with their subscriptions.
+// Implementations must be safe for concurrent use.
+//
+// See [WithLocalKeyStore].
+type LocalKeyStore interface {
+	// Load returns the local key of a subscription endpoint, or nil if not found.
+	Load(endpoint string) (*LocalKey, error)
+	// Store saves the local key of a subscription endpoint, replacing the existing one.
+	Store(endpoint string, key *LocalKey) error
+	// Delete removes the local key of a subscription endpoint, if any,
+	// for example when the subscription is removed or re-keyed.
+	Delete(endpoint string) error
+}
+
+// loadLocalKey loads and decodes the local key of an endpoint from the store.
+// An invalid stored key, one that cannot be opened, or one derived from other subscription keys
+// (fingerprint mismatch), is ignored, so it will be replaced by a new one.
+func (p *VAPIDPusher) loadLocalKey(endpoint string, fingerprint string) (parsedLocalKey, error) {
+	var parsed parsedLocalKey
+	lk, err := p.localKeyStore.Load(endpoint)
+	if err != nil {
+		return parsed, fmt.Errorf("error loading local key: %w", err)
+	}
+	if !lk.hasIKM() || lk.Fingerprint != fingerprint {
+		return parsed, nil
+	}
+	if err := parsed.parse(lk); err != nil {
+		return parsedLocalKey{}, nil
+	}
+	if err := p.openLocalKey(&parsed); err != nil {
+		return parsedLocalKey{}, nil
+	}
+	return parsed, nil
+}
+
+// MemoryLocalKeyStore is an in-memory [LocalKeyStore],
+// which evicts the least recently used keys when full.
+type MemoryLocalKeyStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type memoryLocalKeyEntry struct {
+	endpoint string
+	key      LocalKey
+}
+
+// NewMemoryLocalKeyStore creates an in-memory store holding up to capacity keys.
+func NewMemoryLocalKeyStore(capacity int) *MemoryLocalKeyStore {
+	return &MemoryLocalKeyStore{
+		capacity: max(capacity, 1),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (s *MemoryLocalKeyStore) Load(endpoint string) (*LocalKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[endpoint]
+	if !ok {
+		return nil, nil
+	}
+	s.lru.MoveToFront(e)
+	key := e.Value.(*memoryLocalKeyEntry).key
+	return &key, nil
+}
+
+func (s *MemoryLocalKeyStore) Store(endpoint string, key *LocalKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[endpoint]; ok {
+		e.Value.(*memoryLocalKeyEntry).key = *key
+		s.lru.MoveToFront(e)
+		return nil
+	}
+	s.entries[endpoint] = s.lru.PushFront(&memoryLocalKeyEntry{endpoint: endpoint, key: *key})
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryLocalKeyEntry).endpoint)
+	}
+	return nil
+}
+
+func (s *MemoryLocalKeyStore) Delete(endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[endpoint]; ok {
+		s.lru.Remove(e)
+		delete(s.entries, endpoint)
+	}
+	return nil
+}
+
+// Len returns the number of stored keys.
+func (s *MemoryLocalKeyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// FileLocalKeyStore is a [LocalKeyStore] persisted to a file, keeping all keys in memory.
+// Stored and deleted keys are appended to the file as json lines, use [FileLocalKeyStore.Compact] to drop the replaced,
+// deleted and expired ones.
+type FileLocalKeyStore struct {
+	mu   sync.RWMutex
+	path string
+	file *os.File
+	keys map[string]LocalKey
+}
+
+type fileLocalKeyEntry struct {
+	Endpoint string    `json:"e"`
+	Key      *LocalKey `json:"lk,omitempty"` // Nil when deleted.
+}
+
+// OpenFileLocalKeyStore opens or creates the store file, and loads the existing keys.
+func OpenFileLocalKeyStore(path string) (*FileLocalKeyStore, error) {
+	s := &FileLocalKeyStore{
+		path: path,
+		keys: make(map[string]LocalKey),
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.read(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := terminateLastLine(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// terminateLastLine appends a newline if the file does not end with one,
+// so the next key is not appended to a truncated line.
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = file.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// read loads the keys from the file, a truncated last line (interrupted write) is ignored.
+func (s *FileLocalKeyStore) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	var pending error
+	for scanner.Scan() {
+		if pending != nil {
+			return pending
+		}
+		var entry fileLocalKeyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			pending = fmt.Errorf("invalid local key store file %s: %w", s.path, err)
+			continue
+		}
+		if entry.Key == nil {
+			delete(s.keys, entry.Endpoint)
+			continue
+		}
+		s.keys[entry.Endpoint] = *entry.Key
+	}
+	return scanner.Err()
+}
+
+func (s *FileLocalKeyStore) Load(endpoint string) (*LocalKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[endpoint]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (s *FileLocalKeyStore) Store(endpoint string, key *LocalKey) error {
+	line, err := json.Marshal(fileLocalKeyEntry{Endpoint: endpoint, Key: key})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.keys[endpoint] = *key
+	return nil
+}
+
+func (s *FileLocalKeyStore) Delete(endpoint string) error {
+	line, err := json.Marshal(fileLocalKeyEntry{Endpoint: endpoint})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, ok := s.keys[endpoint]; !ok {
+		return nil
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	delete(s.keys, endpoint)
+	return nil
+}
+
+// Compact rewrites the file with only the current keys, dropping the keys created before expiredBefore.
+// Use the zero time to keep all keys.
+func (s *FileLocalKeyStore) Compact(expiredBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if !expiredBefore.IsZero() {
+		for endpoint, key := range s.keys {
+			if key.At < expiredBefore.UnixMilli() {
+				delete(s.keys, endpoint)
+			}
+		}
+	}
+
+	// Write to a temporary file then rename, so the store is never partially written.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for endpoint, key := range s.keys {
+		if err = enc.Encode(fileLocalKeyEntry{Endpoint: endpoint, Key: &key}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0o600)
+	}
+	if err = errors.Join(err, tmp.Close()); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	// The store is closed if the new file cannot be opened, as the old one was replaced.
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	_ = s.file.Close()
+	s.file = file
+	return err
+}
+
+// Close closes the store file.
+func (s *FileLocalKeyStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
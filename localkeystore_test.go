@@ -0,0 +1,189 @@
+package fwebpush
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryLocalKeyStore(t *testing.T) {
+	store := NewMemoryLocalKeyStore(2)
+	for i, endpoint := range []string{"a", "b"} {
+		if err := store.Store(endpoint, &LocalKey{Public: endpoint, At: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Access a, so b is the least recently used.
+	if key, _ := store.Load("a"); key == nil || key.Public != "a" {
+		t.Fatalf("Incorrect key, expected=a, got=%v", key)
+	}
+	if err := store.Store("c", &LocalKey{Public: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load("b"); key != nil {
+		t.Fatalf("Expected b to be evicted, got=%v", key)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("Incorrect len, expected=2, got=%d", store.Len())
+	}
+	// Replace.
+	if err := store.Store("a", &LocalKey{Public: "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load("a"); key == nil || key.Public != "a2" {
+		t.Fatalf("Incorrect key, expected=a2, got=%v", key)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load("a"); key != nil || store.Len() != 1 {
+		t.Fatalf("Expected a to be deleted, got=%v", key)
+	}
+}
+
+func TestFileLocalKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.jsonl")
+	store, err := OpenFileLocalKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	keys := map[string]LocalKey{
+		"old":   {Public: "old", IKM: "m", At: now.Add(-time.Hour).UnixMilli()},
+		"fresh": {Public: "fresh", IKM: "m", At: now.UnixMilli()},
+	}
+	for endpoint, key := range keys {
+		if err := store.Store(endpoint, &key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replaced := LocalKey{Public: "replaced", IKM: "m", At: now.UnixMilli()}
+	if err := store.Store("fresh", &replaced); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an interrupted write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"e":"partial","lk":{"p":`)
+	_ = f.Close()
+
+	store, err = OpenFileLocalKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if key, _ := store.Load("fresh"); key == nil || *key != replaced {
+		t.Fatalf("Incorrect key, expected=%v, got=%v", replaced, key)
+	}
+	if key, _ := store.Load("partial"); key != nil {
+		t.Fatalf("Expected partial key to be ignored, got=%v", key)
+	}
+	if err := store.Store("new", &LocalKey{Public: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load("new"); key != nil {
+		t.Fatalf("Expected new key to be deleted, got=%v", key)
+	}
+
+	if err := store.Compact(now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load("old"); key != nil {
+		t.Fatalf("Expected old key to be dropped, got=%v", key)
+	}
+	if err := store.Store("after", &LocalKey{Public: "after", At: now.UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Fatalf("Incorrect compacted lines, expected=2, got=%d\n%s", lines, data)
+	}
+
+	if err := store.Delete("after"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileLocalKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if key, _ := reopened.Load("fresh"); key == nil {
+		t.Fatal("Missing key fresh")
+	}
+	if key, _ := reopened.Load("after"); key != nil {
+		t.Fatalf("Expected after key to stay deleted, got=%v", key)
+	}
+}
+
+func TestLocalKeyStorePusher(t *testing.T) {
+	store := NewMemoryLocalKeyStore(10)
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour), WithLocalKeyStore(store))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := readRequestBody(t, p, message, &sub, Options{})
+	if sub.LocalKey != nil {
+		t.Fatal("Expected the subscription to not be modified")
+	}
+	if key, _ := store.Load(sub.Endpoint); key == nil {
+		t.Fatal("Expected the local key to be stored")
+	}
+
+	second := readRequestBody(t, p, message, &sub, Options{})
+	third, _, err := p.AppendEncryptedParsed(nil, message, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range [][]byte{second, third} {
+		// The local public key (keyid) is reused.
+		if !bytes.Equal(body[localPublicKeyOffset:dataOffset], first[localPublicKeyOffset:dataOffset]) {
+			t.Fatal("Expected the local key to be reused")
+		}
+		plaintext, err := DecryptNotification(body, privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+		}
+	}
+
+	// The subscription is re-keyed under the same endpoint, the stored key is not reused.
+	stored, _ := store.Load(sub.Endpoint)
+	rekeyed, privateKey, authSecret := newTestReceiver(t)
+	rekeyed.Endpoint = sub.Endpoint
+	for range 2 {
+		body := readRequestBody(t, p, message, &rekeyed, Options{})
+		if _, err := DecryptNotification(body, privateKey, authSecret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if key, _ := store.Load(sub.Endpoint); key == nil || key.IKM == stored.IKM || key.Fingerprint == stored.Fingerprint {
+		t.Fatalf("Expected the local key to be replaced, got=%v", key)
+	}
+
+	if err := store.Delete(sub.Endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Load(sub.Endpoint); key != nil {
+		t.Fatal("Expected the local key to be deleted")
+	}
+}
@@ -0,0 +1,225 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// encryptedMessageVersion is the version of the binary form of [EncryptedMessage].
+const encryptedMessageVersion = 1
+
+var ErrInvalidMessage = errors.New("invalid encrypted message")
+
+// EncryptedMessage is an encrypted push notification, holding everything required to deliver it.
+// It is transport-agnostic, and can be serialized to be delivered by another process.
+type EncryptedMessage struct {
+	// Endpoint is the push service endpoint of the subscription.
+	Endpoint string `json:"endpoint"`
+	// Header are the request headers: Content-Encoding, TTL, Urgency, Topic, Authorization...
+	Header http.Header `json:"header"`
+	// Body is the encrypted body.
+	Body []byte `json:"body"`
+	// Expiry is the expiration of the VAPID token in the Authorization header,
+	// the message must be delivered before this time.
+	Expiry time.Time `json:"expiry,omitzero"`
+	// LocalKey is the local key generated by the local secret caching, nil if the existing one was reused.
+	// The caller should save it to the subscription for later reuse. Not serialized.
+	LocalKey *LocalKey `json:"-"`
+}
+
+// EncryptNotification encrypts a push notification for a subscription, without sending it.
+// Message Encryption for Web Push, and VAPID protocols.
+// FOR MORE INFORMATION SEE RFC8291: https://datatracker.ietf.org/doc/rfc8291.
+//
+// The message can then be sent using [VAPIDPusher.SendEncrypted] or [EncryptedMessage.NewRequest],
+// or serialized to be sent by another process.
+//
+// The subscription is not modified, so it is safe to encrypt concurrently for the same subscription.
+// When the local secret caching generates a new local key, it is returned in [EncryptedMessage.LocalKey].
+func (p *VAPIDPusher) EncryptNotification(message []byte, sub *Subscription, options Options) (EncryptedMessage, error) {
+	return p.encryptSubscription(nil, message, sub, options)
+}
+
+// SendEncrypted sends an encrypted message to its endpoint using the underlying client.
+func (p *VAPIDPusher) SendEncrypted(ctx context.Context, msg EncryptedMessage) (*http.Response, error) {
+	req, err := msg.NewRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.Do(req)
+}
+
+// IsExpired returns whether the VAPID token of the message is expired,
+// in which case the message must be encrypted again.
+func (m EncryptedMessage) IsExpired(now time.Time) bool {
+	return !m.Expiry.IsZero() && !now.Before(m.Expiry)
+}
+
+// NewRequest creates the push request of the message, which can be sent using any http client.
+// The request shares the header and body of the message.
+func (m EncryptedMessage) NewRequest(ctx context.Context) (*http.Request, error) {
+	return m.newRequest(ctx, nil)
+}
+
+// newRequest creates the push request, the body reads the record from the pooled buffer if not nil.
+func (m EncryptedMessage) newRequest(ctx context.Context, buf *recordBuffer) (*http.Request, error) {
+	var body io.Reader = bytes.NewReader(m.Body)
+	if buf != nil {
+		pooled, err := buf.body(m.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = pooled
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.Endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		req.ContentLength = int64(len(m.Body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return buf.body(m.Body)
+		}
+	}
+	req.Header = m.Header
+	return req, nil
+}
+
+// MarshalBinary encodes the message into a compact binary form.
+func (m EncryptedMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+// AppendBinary appends the binary form of the message to b.
+//
+// The binary form:
+//   - version (1)
+//   - expiry, unix milliseconds (varint), 0 if not set
+//   - endpoint (uvarint length prefixed)
+//   - body (uvarint length prefixed)
+//   - header count (uvarint), followed by each name and value (uvarint length prefixed), sorted by name
+func (m EncryptedMessage) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, encryptedMessageVersion)
+	var expiry int64
+	if !m.Expiry.IsZero() {
+		expiry = m.Expiry.UnixMilli()
+	}
+	b = binary.AppendVarint(b, expiry)
+	b = appendBinaryBytes(b, m.Endpoint)
+	b = appendBinaryBytes(b, m.Body)
+
+	names := make([]string, 0, len(m.Header))
+	count := 0
+	for name, values := range m.Header {
+		names = append(names, name)
+		count += len(values)
+	}
+	slices.Sort(names)
+	b = binary.AppendUvarint(b, uint64(count))
+	for _, name := range names {
+		for _, value := range m.Header[name] {
+			b = appendBinaryBytes(b, name)
+			b = appendBinaryBytes(b, value)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message from the binary form produced by [EncryptedMessage.MarshalBinary].
+func (m *EncryptedMessage) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != encryptedMessageVersion {
+		return fmt.Errorf("unsupported version %w", ErrInvalidMessage)
+	}
+	r := binaryReader{data: data[1:]}
+	expiry := r.varint()
+	endpoint := r.bytes()
+	body := r.bytes()
+	count := r.uvarint()
+	if r.err != nil {
+		return r.err
+	}
+	// Each header takes at least 2 octets.
+	if count > uint64(len(r.data)/2) {
+		return fmt.Errorf("invalid header count %w", ErrInvalidMessage)
+	}
+	header := make(http.Header, count)
+	for range count {
+		name := string(r.bytes())
+		value := string(r.bytes())
+		header[name] = append(header[name], value)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return fmt.Errorf("trailing data %w", ErrInvalidMessage)
+	}
+
+	*m = EncryptedMessage{
+		Endpoint: string(endpoint),
+		Header:   header,
+		Body:     bytes.Clone(body),
+	}
+	if expiry != 0 {
+		m.Expiry = time.UnixMilli(expiry)
+	}
+	return nil
+}
+
+func appendBinaryBytes[T string | []byte](b []byte, data T) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// binaryReader decodes the binary form, stopping at the first error.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("truncated data %w", ErrInvalidMessage)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("truncated data %w", ErrInvalidMessage)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("truncated data %w", ErrInvalidMessage)
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
@@ -0,0 +1,149 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncryptNotification(t *testing.T) {
+	for _, encoding := range []ContentEncoding{ContentEncodingAES128GCM, ContentEncodingAESGCM} {
+		t.Run(string(encoding), func(t *testing.T) {
+			p := newTestPusher(t, WithContentEncoding(encoding))
+			sub, privateKey, authSecret := newTestReceiver(t)
+			msg, err := p.EncryptNotification(message, &sub, Options{TTL: 60, Topic: "topic", Urgency: UrgencyHigh})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Endpoint != sub.Endpoint {
+				t.Fatalf("Incorrect endpoint, expected=%s, got=%s", sub.Endpoint, msg.Endpoint)
+			}
+			if msg.IsExpired(time.Now()) || !msg.IsExpired(msg.Expiry) {
+				t.Fatalf("Incorrect expiry %v", msg.Expiry)
+			}
+			expected := map[string]string{
+				"Content-Encoding": string(encoding),
+				"TTL":              "60",
+				"Topic":            "topic",
+				"Urgency":          string(UrgencyHigh),
+			}
+			for name, value := range expected {
+				if v := msg.Header[name]; len(v) != 1 || v[0] != value {
+					t.Fatalf("Incorrect header %s, expected=%s, got=%v", name, value, v)
+				}
+			}
+			if msg.Header.Get("Authorization") == "" {
+				t.Fatal("Missing Authorization header")
+			}
+
+			// Both serialized forms must round trip.
+			b, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromBinary EncryptedMessage
+			if err := fromBinary.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			j, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromJSON EncryptedMessage
+			if err := json.Unmarshal(j, &fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			for _, decoded := range []EncryptedMessage{fromBinary, fromJSON} {
+				if decoded.Endpoint != msg.Endpoint || !bytes.Equal(decoded.Body, msg.Body) ||
+					!reflect.DeepEqual(decoded.Header, msg.Header) || msg.Expiry.Sub(decoded.Expiry).Abs() >= time.Millisecond {
+					t.Fatalf("Incorrect decoded message, expected=%+v, got=%+v", msg, decoded)
+				}
+
+				var plaintext []byte
+				if encoding == ContentEncodingAESGCM {
+					plaintext, err = DecryptAESGCMNotification(decoded.Body, decoded.Header, privateKey, authSecret)
+				} else {
+					plaintext, err = DecryptNotification(decoded.Body, privateKey, authSecret)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plaintext, message) {
+					t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+				}
+			}
+		})
+	}
+}
+
+func TestSendEncrypted(t *testing.T) {
+	var received preparedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = preparedRequest{header: r.Header, body: body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	p := newTestPusher(t, WithClient(server.Client()))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	sub.Endpoint = server.URL
+	msg, err := p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.SendEncrypted(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Incorrect status, expected=%d, got=%d", http.StatusCreated, res.StatusCode)
+	}
+	if v := received.header.Get("Authorization"); v != msg.Header.Get("Authorization") {
+		t.Fatalf("Incorrect Authorization header, expected=%s, got=%s", msg.Header.Get("Authorization"), v)
+	}
+	plaintext, err := DecryptNotification(received.body, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+	}
+}
+
+func TestEncryptedMessageUnmarshalBinaryInvalid(t *testing.T) {
+	msg := EncryptedMessage{
+		Endpoint: "https://example.com",
+		Header:   http.Header{"TTL": {"0"}},
+		Body:     []byte("body"),
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every truncation must be detected.
+	for i := range b {
+		var decoded EncryptedMessage
+		if err := decoded.UnmarshalBinary(b[:i]); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("Expected ErrInvalidMessage at %d, got=%v", i, err)
+		}
+	}
+	var decoded EncryptedMessage
+	if err := decoded.UnmarshalBinary(append(b, 0)); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("Expected ErrInvalidMessage, got=%v", err)
+	}
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Expiry.IsZero() {
+		t.Fatalf("Expected zero expiry, got=%v", decoded.Expiry)
+	}
+}
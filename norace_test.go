@@ -0,0 +1,5 @@
+//go:build !race
+
+package fwebpush
+
+const raceEnabled = false
@@ -1,8 +1,11 @@
 package fwebpush
 
 import (
+	"crypto/ecdh"
+	"github.com/mawngo/go-fwebpush/ece"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -24,6 +27,51 @@ func WithVAPIDTokenTTL(exp time.Duration) VAPIDPusherOption {
 	}
 }
 
+// WithVAPIDIdentities configure additional VAPID key pairs, selected by the Subscription.VAPIDKeyID,
+// so the VAPID keys can be rotated without breaking the existing subscriptions.
+// Subscriptions without key ID keep using the pusher key pair.
+//
+// To rotate, add the new key pair with a NotBefore, so [VAPIDPusher.ApplicationServerKey] returns it
+// for new subscriptions from that time, and set the NotAfter of the old key pair once its users have re-subscribed.
+// The cached VAPID tokens are per key pair and audience.
+func WithVAPIDIdentities(identities ...VAPIDIdentity) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.vapidIdentityConfigs = identities
+	}
+}
+
+// WithVAPIDTokenCacheSize configure the max number of cached VAPID tokens, one per VAPID key pair and audience.
+// When full, the least recently used token is dropped, so the size should be at least the number of audiences
+// sent to within the token TTL.
+// Default 10000.
+func WithVAPIDTokenCacheSize(size int) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.tokenCacheSize = size
+	}
+}
+
+// WithVAPIDTokenCacheSweepInterval configure the interval of dropping the expired VAPID tokens,
+// for the audiences that are not sent to anymore. The sweep runs when caching a new token.
+// Set to 0 to only drop them when evicted.
+// Default 10 minutes.
+func WithVAPIDTokenCacheSweepInterval(interval time.Duration) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.tokenCacheSweep = interval
+	}
+}
+
+// WithTokenCache configure a cache of VAPID tokens shared across processes, see [TokenCache] and [KVTokenCache].
+// Set to nil to disable.
+// When the token of an audience is missing or about to expire, the shared token is used if still valid,
+// otherwise a new token is signed and shared. The shared cache failures are ignored, the token is then signed locally.
+//
+// Requires the VAPID token caching, see [WithVAPIDTokenTTL].
+func WithTokenCache(cache TokenCache) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.tokenCache = cache
+	}
+}
+
 // WithVAPIDTokenTTLExt additional duration added to expiration.
 // The key will expire later than configured expiration this amount of duration,
 // while the validation of the key will expire sooner than configured expiration this amount of duration,
@@ -37,16 +85,106 @@ func WithVAPIDTokenTTLExt(exp time.Duration) VAPIDPusherOption {
 }
 
 // WithRandReader allow switching randReader implementation.
+// The reader is the source of all randomness: the salt, the local key pair,
+// and the VAPID token and ES256 payload signatures.
+// As the standard library ignores custom random sources when signing,
+// the VAPID token and the ES256 payload are signed deterministically (RFC 6979)
+// when the reader is not crypto/rand.Reader.
+//
+// Combined with [WithLocalPrivateKey], a deterministic reader makes the encryption fully reproducible,
+// which is useful for testing.
 func WithRandReader(rand io.Reader) VAPIDPusherOption {
 	return func(pusher *VAPIDPusher) {
 		pusher.randReader = rand
 	}
 }
 
+// WithLocalPrivateKey configure a fixed local (application server) key pair, used for ECDH key agreement
+// instead of generating one.
+// The local key pair must be ephemeral, only use this option for testing.
+func WithLocalPrivateKey(key *ecdh.PrivateKey) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localPrivateKey = key
+	}
+}
+
+// WithLocalKeyRotation configure the rotation interval of the ephemeral local (application server) key pair,
+// separately from the VAPID token caching.
+// By default, the local key pair is cached with the VAPID token of each audience and rotated with it.
+// Set to 0 to restore the default, see [WithPerMessageLocalKey] for generating a key pair per message.
+func WithLocalKeyRotation(interval time.Duration) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localKeyRotation = max(interval, 0)
+	}
+}
+
+// WithPerMessageLocalKey configure generating a new local key pair for every message,
+// while still caching the VAPID token.
+//
+// The local secret caching (see [WithLocalSecretTTL]) still reuses the local key of the subscription.
+func WithPerMessageLocalKey() VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localKeyRotation = -1
+	}
+}
+
+// WithLocalKeyPool configure a pool of pre-generated local key pairs, used instead of generating them
+// when sending, see [LocalKeyPool].
+// Set to nil to disable.
+//
+// The pooled key pairs are generated using crypto/rand, ignoring [WithRandReader].
+func WithLocalKeyPool(pool *LocalKeyPool) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localKeyPool = pool
+	}
+}
+
+// WithZeroization configure clearing the key material once a request is prepared:
+// the pooled key buffers holding the auth secret, the ECDH shared secret, the IKM and the content-encryption key,
+// and the VAPID signing key.
+// Use [VAPIDPusher.Close] to wipe the VAPID private key and the cached keys.
+//
+// This is best effort, copies made by the standard library (ECDH private keys, ciphers, HKDF state) cannot be cleared.
+func WithZeroization() VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.zeroize = true
+	}
+}
+
+// WithPayloadSigner configure signing of the plaintext payload before encryption,
+// the service worker receives the signed envelope instead of the payload, see [PayloadSigner] for the format.
+// Set to nil to disable.
+//
+// The envelope adds 75 bytes plus the key ID to the payload.
+func WithPayloadSigner(signer *PayloadSigner) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.payloadSigner = signer
+	}
+}
+
+// WithPayloadCompression configure the compression of the payload before encryption.
+// The payload is prefixed by a 1 byte header: [PayloadUncompressed], or [PayloadDeflate] followed by the raw deflate
+// compressed payload, which the service worker can decompress using DecompressionStream("deflate-raw").
+// The payload is only compressed when it exceeds the max record size uncompressed, and compression makes it smaller.
+//
+// The compression applies to the signed envelope when combined with [WithPayloadSigner].
+//
+// Compressing before encryption leaks information about the plaintext through the encrypted size (CRIME/BREACH-style):
+// an attacker who can influence part of a payload that also contains a secret, and observe the size of the pushed
+// message, can guess the secret. Do not enable it for such payloads, or pad them to a fixed size (see [WithPadding]).
+func WithPayloadCompression() VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.compressPayload = true
+	}
+}
+
 // WithLocalSecretTTL configure reusing of the local secret and public key.
 // Set to 0 to disable.
 // When enabled, the pusher will check the LocalKey of the Subscription and generate if not have one or expired.
 // You can save the generated LocalKey with the Subscription to reuse later.
+//
+// The send APIs taking a *Subscription write the generated LocalKey to it, so they must not be used concurrently
+// for the same subscription. Use [VAPIDPusher.EncryptNotification] instead, which returns the generated LocalKey.
 func WithLocalSecretTTL(exp time.Duration) VAPIDPusherOption {
 	return func(pusher *VAPIDPusher) {
 		pusher.localSecretTTLFn = func() time.Duration {
@@ -55,6 +193,31 @@ func WithLocalSecretTTL(exp time.Duration) VAPIDPusherOption {
 	}
 }
 
+// WithLocalKeyStore configure the store of the local keys generated by the local secret caching.
+// Set to nil to disable.
+// When configured, the LocalKey is loaded from the store if the Subscription does not have one,
+// and the generated LocalKey is saved to the store instead of the Subscription.
+//
+// Requires the local secret caching to be enabled, see [WithLocalSecretTTL].
+func WithLocalKeyStore(store LocalKeyStore) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localKeyStore = store
+	}
+}
+
+// WithLocalKeyRing configure sealing of the IKM of the generated LocalKey, so it is never persisted in cleartext.
+// Set to nil to disable.
+// Sealed LocalKey, from the Subscription or the [LocalKeyStore], are opened transparently when sending,
+// and cleartext LocalKey are still accepted.
+//
+// To rotate the key-encryption key, configure a new key ring with the new primary key,
+// keeping the old keys until every LocalKey sealed by them expires or is resealed using [LocalKeyRing.Seal].
+func WithLocalKeyRing(ring *LocalKeyRing) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.localKeyRing = ring
+	}
+}
+
 // WithLocalSecretTTLFn configure reusing of the local secret and public key.
 // Set to nil to disable.
 //
@@ -69,9 +232,25 @@ func WithLocalSecretTTLFn(fn func() time.Duration) VAPIDPusherOption {
 // Payload that has length exceed the configured size will not be padded.
 // The maximum accepted value is [MaxRecordSize].
 // The default value is 0 (disabled).
+//
+// This is a shortcut for [WithPadding] using [PadFixed].
 func WithRecordSize(size int) VAPIDPusherOption {
 	return func(pusher *VAPIDPusher) {
-		pusher.recordSize = min(max(size, 0), MaxRecordSize)
+		if size <= 0 {
+			pusher.padding = nil
+			return
+		}
+		pusher.padding = PadFixed(min(size, MaxRecordSize))
+	}
+}
+
+// WithPadding configure the padding policy of the message payload,
+// see [PadFixed], [PadBuckets], [PadRandom] and [PadToMax].
+// The padded size never exceeds the max record size, see [WithMaxRecordSize].
+// The default value is nil (disabled).
+func WithPadding(padding Padding) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.padding = padding
 	}
 }
 
@@ -91,3 +270,55 @@ func WithMaxRecordSize(size int) VAPIDPusherOption {
 		pusher.maxRecordSize = min(max(size, 103), MaxRecordSize)
 	}
 }
+
+// WithContentEncoding configure the default content encoding of the pushed message.
+// The content encoding of the Subscription or the Options take precedence over this setting.
+// The default value is [ContentEncodingAES128GCM].
+func WithContentEncoding(encoding ContentEncoding) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.contentEncoding = encoding
+	}
+}
+
+// WithVAPIDScheme configure the default scheme of the VAPID Authorization header.
+// The scheme configured for the endpoint host using [WithVAPIDSchemeForHosts] takes precedence over this setting.
+// The default value is [VAPIDSchemeVAPID].
+//
+// With [VAPIDSchemeWebPush], the public key is sent using the Crypto-Key header,
+// the callers of [VAPIDPusher.AppendEncrypted] must set both headers, see [VAPIDPusher.VAPIDHeaders].
+func WithVAPIDScheme(scheme VAPIDScheme) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		pusher.vapidScheme = scheme
+	}
+}
+
+// WithVAPIDSchemeForHosts configure the scheme of the VAPID Authorization header for the endpoint hosts,
+// such as push relays that predate RFC8292 and only accept [VAPIDSchemeWebPush].
+// The host must include the port if the endpoint has one, the matching is case-insensitive.
+func WithVAPIDSchemeForHosts(scheme VAPIDScheme, hosts ...string) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		if pusher.vapidHostSchemes == nil {
+			pusher.vapidHostSchemes = make(map[string]VAPIDScheme, len(hosts))
+		}
+		for _, host := range hosts {
+			pusher.vapidHostSchemes[strings.ToLower(host)] = scheme
+		}
+	}
+}
+
+// WithRS configure the RFC8188 record size (rs) of the aes128gcm encoding.
+// When set, the message is split into multiple records of this size,
+// which allow sending messages larger than a single record to push services and receivers that accept them
+// (use [WithMaxRecordSize] to disable the max size validation).
+// The minimum accepted value is 18, which includes: padding delimiter (1 octet),
+// expansion for AEAD_AES_128_GCM (16 octets) and at least 1 octet of data.
+// The default value is 0, which writes the whole message into a single record.
+func WithRS(rs int) VAPIDPusherOption {
+	return func(pusher *VAPIDPusher) {
+		if rs <= 0 {
+			pusher.rs = 0
+			return
+		}
+		pusher.rs = max(rs, ece.MinRS)
+	}
+}
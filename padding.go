@@ -0,0 +1,108 @@
+package fwebpush
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+// Padding is a policy deciding the padded size of the push message record,
+// to prevent leaking the message type through the message length.
+// The result is always clamped between the unpadded size and the max record size,
+// see [WithMaxRecordSize].
+type Padding interface {
+	// PaddedSize returns the target record size for an unpadded record of size n.
+	// The maxSize is the maximum allowed record size, random is the configured random source.
+	PaddedSize(n int, maxSize int, random io.Reader) (int, error)
+}
+
+// PadFixed pad the record up to the specified size.
+// Record that has length exceed the size will not be padded.
+func PadFixed(size int) Padding {
+	return fixedPadding(size)
+}
+
+// PadBuckets pad the record up to the next of the configured sizes.
+// Record that has length exceed all sizes is padded to the max record size.
+func PadBuckets(sizes ...int) Padding {
+	sizes = slices.Clone(sizes)
+	slices.Sort(sizes)
+	return bucketPadding(sizes)
+}
+
+// PadRandom pad the record with a random amount of padding, between minPad and maxPad octets (inclusive).
+func PadRandom(minPad int, maxPad int) Padding {
+	if maxPad < minPad {
+		minPad, maxPad = maxPad, minPad
+	}
+	return randomPadding{min: max(minPad, 0), max: max(maxPad, 0)}
+}
+
+// PadToMax pad all records up to the max record size,
+// for sensitive notifications that must not leak any length information.
+func PadToMax() Padding {
+	return maxPadding{}
+}
+
+type fixedPadding int
+
+func (p fixedPadding) PaddedSize(n int, _ int, _ io.Reader) (int, error) {
+	return max(n, int(p)), nil
+}
+
+type bucketPadding []int
+
+func (p bucketPadding) PaddedSize(n int, maxSize int, _ io.Reader) (int, error) {
+	for _, size := range p {
+		if size >= n {
+			return size, nil
+		}
+	}
+	return maxSize, nil
+}
+
+type randomPadding struct {
+	min int
+	max int
+}
+
+func (p randomPadding) PaddedSize(n int, _ int, random io.Reader) (int, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(random, b[:]); err != nil {
+		return 0, err
+	}
+	// The modulo bias is negligible for any realistic range.
+	span := uint64(p.max-p.min) + 1
+	return n + p.min + int(binary.BigEndian.Uint64(b[:])%span), nil
+}
+
+type maxPadding struct{}
+
+func (maxPadding) PaddedSize(_ int, maxSize int, _ io.Reader) (int, error) {
+	return maxSize, nil
+}
+
+// paddedSize returns the target record size of an unpadded record of size n.
+// Options take precedence over the pusher setting.
+func (p *VAPIDPusher) paddedSize(n int, options Options) (int, error) {
+	padding := p.padding
+	if options.Padding != nil {
+		padding = options.Padding
+	}
+	if options.RecordSize > 0 {
+		padding = PadFixed(options.RecordSize)
+	}
+	if padding == nil {
+		return n, nil
+	}
+	maxSize := p.maxRecordSize
+	if maxSize <= 0 {
+		maxSize = MaxRecordSize
+	}
+	size, err := padding.PaddedSize(n, maxSize, p.randReader)
+	if err != nil {
+		return 0, errors.Join(ErrEncryption, err)
+	}
+	return max(min(size, maxSize), n), nil
+}
@@ -0,0 +1,59 @@
+package fwebpush
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadding(t *testing.T) {
+	short := []byte("short")
+	cases := []struct {
+		name     string
+		options  []VAPIDPusherOption
+		message  []byte
+		opts     Options
+		min, max int
+	}{
+		{"none", nil, short, Options{}, headerLen + len(short) + 17, headerLen + len(short) + 17},
+		{"fixed", []VAPIDPusherOption{WithPadding(PadFixed(512))}, short, Options{}, 512, 512},
+		{"fixed exceeded", []VAPIDPusherOption{WithPadding(PadFixed(128))}, message, Options{}, headerLen + len(message) + 17, headerLen + len(message) + 17},
+		{"buckets", []VAPIDPusherOption{WithPadding(PadBuckets(1024, 256, 512))}, short, Options{}, 256, 256},
+		{"buckets next", []VAPIDPusherOption{WithPadding(PadBuckets(256, 512, 1024))}, message, Options{}, 512, 512},
+		{"buckets exceeded", []VAPIDPusherOption{WithPadding(PadBuckets(128))}, message, Options{}, MaxRecordSize, MaxRecordSize},
+		{"buckets respect max", []VAPIDPusherOption{WithPadding(PadBuckets(128)), WithMaxRecordSize(1000)}, message, Options{}, 1000, 1000},
+		{"random", []VAPIDPusherOption{WithPadding(PadRandom(10, 100))}, short, Options{}, headerLen + len(short) + 17 + 10, headerLen + len(short) + 17 + 100},
+		{"random respect max", []VAPIDPusherOption{WithPadding(PadRandom(5000, 6000))}, short, Options{}, MaxRecordSize, MaxRecordSize},
+		{"max", []VAPIDPusherOption{WithPadding(PadToMax())}, short, Options{}, MaxRecordSize, MaxRecordSize},
+		{"max configured", []VAPIDPusherOption{WithPadding(PadToMax()), WithMaxRecordSize(2000)}, short, Options{}, 2000, 2000},
+		{"max disabled", []VAPIDPusherOption{WithPadding(PadToMax()), WithMaxRecordSize(0)}, short, Options{}, MaxRecordSize, MaxRecordSize},
+		{"options", []VAPIDPusherOption{WithPadding(PadFixed(512))}, short, Options{Padding: PadToMax()}, MaxRecordSize, MaxRecordSize},
+		{"options record size", []VAPIDPusherOption{WithPadding(PadToMax())}, short, Options{RecordSize: 512}, 512, 512},
+		{"multiple records", []VAPIDPusherOption{WithPadding(PadToMax()), WithRS(100)}, short, Options{}, MaxRecordSize - 17, MaxRecordSize},
+		{"aesgcm", []VAPIDPusherOption{WithPadding(PadToMax()), WithContentEncoding(ContentEncodingAESGCM)}, short, Options{}, MaxRecordSize, MaxRecordSize},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, c.options...)
+			sub, privateKey, authSecret := newTestReceiver(t)
+			for range 10 {
+				req := readRequest(t, p, c.message, &sub, c.opts)
+				if len(req.body) < c.min || len(req.body) > c.max {
+					t.Fatalf("Incorrect padded size, expected=[%d, %d], got=%d", c.min, c.max, len(req.body))
+				}
+				var plaintext []byte
+				var err error
+				if req.header.Get("Content-Encoding") == string(ContentEncodingAESGCM) {
+					plaintext, err = DecryptAESGCMNotification(req.body, req.header, privateKey, authSecret)
+				} else {
+					plaintext, err = DecryptNotification(req.body, privateKey, authSecret)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plaintext, c.message) {
+					t.Fatalf("Incorrect plaintext, expected=%q, got=%q", c.message, plaintext)
+				}
+			}
+		})
+	}
+}
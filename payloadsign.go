@@ -0,0 +1,214 @@
+package fwebpush
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	jwt2 "github.com/mawngo/go-fwebpush/internal/jwt"
+	"io"
+	"time"
+)
+
+// Signed payload envelope format.
+const (
+	signedPayloadVersion = 1
+
+	// SignedPayloadEd25519 is the algorithm of an envelope signed by an Ed25519 key.
+	SignedPayloadEd25519 = 1
+	// SignedPayloadES256 is the algorithm of an envelope signed by an ECDSA P-256 key (SHA-256, r || s signature).
+	SignedPayloadES256 = 2
+
+	signedPayloadHeaderLen = 1 + 1 + 8 + 1
+	signedPayloadSignLen   = 64
+	maxPayloadKeyIDLen     = 255
+)
+
+var ErrInvalidPayloadSignature = errors.New("invalid payload signature")
+
+// PayloadSigner signs the plaintext payload before encryption, so the service worker can verify
+// that a notification comes from the application server, independently of the push service.
+//
+// The signed payload is an envelope, integers are big endian:
+//   - version (1)
+//   - algorithm (1): [SignedPayloadEd25519] or [SignedPayloadES256]
+//   - timestamp (8): unix milliseconds
+//   - key ID length (1), followed by the key ID
+//   - payload
+//   - signature (64) of all the above
+//
+// The signature can be verified using WebCrypto, with {name: "Ed25519"} or {name: "ECDSA", hash: "SHA-256"}.
+// See [WithPayloadSigner] and [PayloadVerifier].
+type PayloadSigner struct {
+	keyID    string
+	alg      byte
+	signer   jwt2.Signer
+	ecdsaKey *ecdsa.PrivateKey // Only for ES256, to sign using the random source of the pusher.
+}
+
+// NewPayloadSigner creates a payload signer from an Ed25519 (ed25519.PrivateKey) or ECDSA P-256 (*ecdsa.PrivateKey) key.
+// The key ID is included in the envelope to select the verification key, up to 255 bytes.
+func NewPayloadSigner(keyID string, key crypto.Signer) (*PayloadSigner, error) {
+	if len(keyID) > maxPayloadKeyIDLen {
+		return nil, fmt.Errorf("key ID exceeds %d bytes", maxPayloadKeyIDLen)
+	}
+	s := &PayloadSigner{keyID: keyID}
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		s.alg = SignedPayloadEd25519
+		s.signer, err = jwt2.NewSignerEdDSA(key)
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported ECDSA curve, only P-256 is supported")
+		}
+		s.alg = SignedPayloadES256
+		s.ecdsaKey = key
+		s.signer, err = jwt2.NewSignerES(jwt2.ES256, key)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// KeyID returns the key ID included in the envelope.
+func (s *PayloadSigner) KeyID() string {
+	return s.keyID
+}
+
+// Sign returns the signed envelope of the payload.
+func (s *PayloadSigner) Sign(payload []byte, now time.Time) ([]byte, error) {
+	return s.AppendSign(nil, payload, now)
+}
+
+// AppendSign appends the signed envelope of the payload to dst.
+func (s *PayloadSigner) AppendSign(dst []byte, payload []byte, now time.Time) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, signedPayloadVersion, s.alg)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(now.UnixMilli()))
+	dst = append(dst, byte(len(s.keyID)))
+	dst = append(dst, s.keyID...)
+	dst = append(dst, payload...)
+	signature, err := s.signer.Sign(dst[start:])
+	if err != nil {
+		return dst[:start], err
+	}
+	return append(dst, signature...), nil
+}
+
+// withRand returns a copy of the signer using the random source, nil for deterministic signatures (RFC 6979).
+// Ed25519 signatures are always deterministic, so the signer is returned unchanged.
+func (s *PayloadSigner) withRand(random io.Reader) (*PayloadSigner, error) {
+	if s.ecdsaKey == nil {
+		return s, nil
+	}
+	signer, err := jwt2.NewSignerESRand(jwt2.ES256, s.ecdsaKey, random)
+	if err != nil {
+		return nil, err
+	}
+	c := *s
+	c.signer = signer
+	return &c, nil
+}
+
+// signedPayloadLen returns the size of the signed envelope of a payload.
+func (s *PayloadSigner) signedPayloadLen(payloadLen int) int {
+	return signedPayloadHeaderLen + len(s.keyID) + payloadLen + signedPayloadSignLen
+}
+
+// signPayload signs the message if a payload signer is configured.
+func (p *VAPIDPusher) signPayload(message []byte, now time.Time) ([]byte, error) {
+	if p.payloadSigner == nil {
+		return message, nil
+	}
+	signed, err := p.payloadSigner.AppendSign(make([]byte, 0, p.payloadSigner.signedPayloadLen(len(message))), message, now)
+	if err != nil {
+		return nil, errors.Join(ErrEncryption, err)
+	}
+	return signed, nil
+}
+
+// SignedPayload is a verified signed payload envelope.
+type SignedPayload struct {
+	KeyID string
+	// Timestamp is the signing time, which should be checked to reject replayed notifications.
+	Timestamp time.Time
+	Payload   []byte
+}
+
+// PayloadVerifier verifies the envelopes signed by a [PayloadSigner], selecting the key by key ID.
+type PayloadVerifier struct {
+	keys map[string]payloadVerifierKey
+}
+
+type payloadVerifierKey struct {
+	alg      byte
+	verifier interface {
+		VerifySignature(payload, signature []byte) error
+	}
+}
+
+// NewPayloadVerifier creates a verifier from the public keys by key ID,
+// either Ed25519 (ed25519.PublicKey) or ECDSA P-256 (*ecdsa.PublicKey).
+func NewPayloadVerifier(keys map[string]crypto.PublicKey) (*PayloadVerifier, error) {
+	v := &PayloadVerifier{keys: make(map[string]payloadVerifierKey, len(keys))}
+	for keyID, key := range keys {
+		var k payloadVerifierKey
+		var err error
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			k.alg = SignedPayloadEd25519
+			k.verifier, err = jwt2.NewVerifierEdDSA(key)
+		case *ecdsa.PublicKey:
+			if key.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("unsupported ECDSA curve for key %q, only P-256 is supported", keyID)
+			}
+			k.alg = SignedPayloadES256
+			k.verifier, err = jwt2.NewVerifierES(jwt2.ES256, key)
+		default:
+			return nil, fmt.Errorf("unsupported key type %T for key %q", key, keyID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", keyID, err)
+		}
+		v.keys[keyID] = k
+	}
+	return v, nil
+}
+
+// Verify verifies the signed envelope, and returns its content.
+// The returned payload shares the memory of the envelope.
+func (v *PayloadVerifier) Verify(envelope []byte) (SignedPayload, error) {
+	if len(envelope) < signedPayloadHeaderLen+signedPayloadSignLen || envelope[0] != signedPayloadVersion {
+		return SignedPayload{}, fmt.Errorf("invalid envelope %w", ErrInvalidPayloadSignature)
+	}
+	alg := envelope[1]
+	at := int64(binary.BigEndian.Uint64(envelope[2:]))
+	keyIDLen := int(envelope[signedPayloadHeaderLen-1])
+	signedLen := len(envelope) - signedPayloadSignLen
+	if signedPayloadHeaderLen+keyIDLen > signedLen {
+		return SignedPayload{}, fmt.Errorf("invalid envelope %w", ErrInvalidPayloadSignature)
+	}
+	keyID := string(envelope[signedPayloadHeaderLen : signedPayloadHeaderLen+keyIDLen])
+	key, ok := v.keys[keyID]
+	if !ok {
+		return SignedPayload{}, fmt.Errorf("unknown key %q %w", keyID, ErrInvalidPayloadSignature)
+	}
+	if key.alg != alg {
+		return SignedPayload{}, fmt.Errorf("algorithm mismatch %w", ErrInvalidPayloadSignature)
+	}
+	if err := key.verifier.VerifySignature(envelope[:signedLen], envelope[signedLen:]); err != nil {
+		return SignedPayload{}, errors.Join(ErrInvalidPayloadSignature, err)
+	}
+	return SignedPayload{
+		KeyID:     keyID,
+		Timestamp: time.UnixMilli(at),
+		Payload:   envelope[signedPayloadHeaderLen+keyIDLen : signedLen],
+	}, nil
+}
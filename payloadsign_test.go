@@ -0,0 +1,153 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPayloadKeys(t testing.TB) (ed25519.PrivateKey, *ecdsa.PrivateKey) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return edKey, esKey
+}
+
+func TestPayloadSigner(t *testing.T) {
+	edKey, esKey := newTestPayloadKeys(t)
+	verifier, err := NewPayloadVerifier(map[string]crypto.PublicKey{
+		"ed": edKey.Public(),
+		"es": esKey.Public(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.UnixMilli(time.Now().UnixMilli())
+	for keyID, key := range map[string]crypto.Signer{"ed": edKey, "es": esKey} {
+		t.Run(keyID, func(t *testing.T) {
+			signer, err := NewPayloadSigner(keyID, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope, err := signer.Sign(message, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(envelope) != signer.signedPayloadLen(len(message)) {
+				t.Fatalf("Incorrect envelope size, expected=%d, got=%d", signer.signedPayloadLen(len(message)), len(envelope))
+			}
+			signed, err := verifier.Verify(envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signed.KeyID != keyID || !signed.Timestamp.Equal(now) || !bytes.Equal(signed.Payload, message) {
+				t.Fatalf("Incorrect signed payload %+v", signed)
+			}
+
+			// Every modification must be detected.
+			for i := range envelope {
+				tampered := bytes.Clone(envelope)
+				tampered[i] ^= 1
+				if _, err := verifier.Verify(tampered); !errors.Is(err, ErrInvalidPayloadSignature) {
+					t.Fatalf("Expected ErrInvalidPayloadSignature at %d, got=%v", i, err)
+				}
+			}
+			for i := range envelope {
+				if _, err := verifier.Verify(envelope[:i]); !errors.Is(err, ErrInvalidPayloadSignature) {
+					t.Fatalf("Expected ErrInvalidPayloadSignature at %d, got=%v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPayloadVerifierKeys(t *testing.T) {
+	edKey, esKey := newTestPayloadKeys(t)
+	signer, err := NewPayloadSigner("key", edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := signer.Sign(message, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]map[string]crypto.PublicKey{
+		"unknown key":        {"other": edKey.Public()},
+		"algorithm mismatch": {"key": esKey.Public()},
+	}
+	for name, keys := range cases {
+		t.Run(name, func(t *testing.T) {
+			verifier, err := NewPayloadVerifier(keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifier.Verify(envelope); !errors.Is(err, ErrInvalidPayloadSignature) {
+				t.Fatalf("Expected ErrInvalidPayloadSignature, got=%v", err)
+			}
+		})
+	}
+}
+
+func TestNewPayloadSignerInvalid(t *testing.T) {
+	edKey, _ := newTestPayloadKeys(t)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPayloadSigner("key", p384Key); err == nil {
+		t.Fatal("Expected error for P-384 key")
+	}
+	if _, err := NewPayloadSigner(strings.Repeat("k", 256), edKey); err == nil {
+		t.Fatal("Expected error for long key ID")
+	}
+	if _, err := NewPayloadVerifier(map[string]crypto.PublicKey{"key": p384Key.Public()}); err == nil {
+		t.Fatal("Expected error for P-384 key")
+	}
+}
+
+func TestPayloadSignerPusher(t *testing.T) {
+	edKey, _ := newTestPayloadKeys(t)
+	signer, err := NewPayloadSigner("key", edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewPayloadVerifier(map[string]crypto.PublicKey{"key": edKey.Public()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPusher(t, WithPayloadSigner(signer))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, _, err := p.AppendEncryptedParsed(nil, message, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range [][]byte{readRequestBody(t, p, message, &sub, Options{}), appended} {
+		envelope, err := DecryptNotification(body, privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := verifier.Verify(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(signed.Payload, message) {
+			t.Fatalf("Incorrect payload, expected=%q, got=%q", message, signed.Payload)
+		}
+	}
+}
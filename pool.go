@@ -0,0 +1,125 @@
+package fwebpush
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// keyBufLen is the length of the pre-allocated key buffer, see the key buffer format.
+const keyBufLen = prkPublicKeyOffset + localPublicKeyLen
+
+// maxPooledRecordLen is the maximum capacity of a pooled record buffer,
+// larger buffers are left to the garbage collector.
+const maxPooledRecordLen = 4 * MaxRecordSize
+
+var errRecordReleased = errors.New("record buffer already released")
+
+var keyBufPool = sync.Pool{
+	New: func() any { return new([keyBufLen]byte) },
+}
+
+var recordBufferPool = sync.Pool{
+	New: func() any { return &recordBuffer{b: make([]byte, 0, MaxRecordSize)} },
+}
+
+// getKeyBuf returns a key buffer from the pool, which must be released using putKeyBuf.
+// The content of the buffer is undefined.
+func getKeyBuf() *[keyBufLen]byte {
+	return keyBufPool.Get().(*[keyBufLen]byte)
+}
+
+func putKeyBuf(keyBuf *[keyBufLen]byte) {
+	keyBufPool.Put(keyBuf)
+}
+
+// releaseKeyBuf returns the key buffer to the pool, cleared first if the zeroization is enabled.
+func (p *VAPIDPusher) releaseKeyBuf(keyBuf *[keyBufLen]byte) {
+	if p.zeroize {
+		clear(keyBuf[:])
+	}
+	putKeyBuf(keyBuf)
+}
+
+// wipe clears the secret if the zeroization is enabled.
+func (p *VAPIDPusher) wipe(secret []byte) {
+	if p.zeroize {
+		clear(secret)
+	}
+}
+
+// recordBuffer is a pooled record buffer, shared by the request bodies of a sent notification.
+// The buffer is returned to the pool once released by the sender and all bodies are closed,
+// as the transport may still read the body after the response is received.
+type recordBuffer struct {
+	b    []byte
+	refs atomic.Int32
+}
+
+// getRecordBuffer returns a record buffer from the pool, holding a reference for the caller.
+func getRecordBuffer() *recordBuffer {
+	buf := recordBufferPool.Get().(*recordBuffer)
+	buf.refs.Store(1)
+	return buf
+}
+
+// body returns a new request body reading the record, which holds a reference until closed.
+func (buf *recordBuffer) body(record []byte) (io.ReadCloser, error) {
+	for {
+		refs := buf.refs.Load()
+		if refs <= 0 {
+			return nil, errRecordReleased
+		}
+		if buf.refs.CompareAndSwap(refs, refs+1) {
+			break
+		}
+	}
+	b := &recordBody{buf: buf}
+	b.r.Reset(record)
+	return b, nil
+}
+
+// release drops a reference, returning the buffer to the pool when there is none left.
+func (buf *recordBuffer) release() {
+	if buf.refs.Add(-1) != 0 {
+		return
+	}
+	if cap(buf.b) > maxPooledRecordLen {
+		return
+	}
+	buf.b = buf.b[:0]
+	recordBufferPool.Put(buf)
+}
+
+// recordBody is a request body reading a pooled record.
+// Reads are guarded, so the buffer is never read once the body is closed.
+type recordBody struct {
+	mu     sync.Mutex
+	r      bytes.Reader
+	buf    *recordBuffer
+	closed bool
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	return b.r.Read(p)
+}
+
+func (b *recordBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.r.Reset(nil)
+	b.buf.release()
+	return nil
+}
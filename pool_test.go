@@ -0,0 +1,207 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendEncrypted(t *testing.T) {
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	prefix := []byte("prefix")
+	dst := append(make([]byte, 0, 1024), prefix...)
+	for range 2 {
+		out, err := p.AppendEncrypted(dst, message, &sub, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out[:len(prefix)], prefix) {
+			t.Fatalf("Incorrect prefix, expected=%q, got=%q", prefix, out[:len(prefix)])
+		}
+		if &out[0] != &dst[0] {
+			t.Fatal("Expected dst to be reused")
+		}
+		plaintext, err := DecryptNotification(out[len(prefix):], privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+		}
+	}
+
+	sub.ContentEncoding = ContentEncodingAESGCM
+	if _, err := p.AppendEncrypted(nil, message, &sub, Options{}); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("Expected ErrUnsupportedEncoding, got=%v", err)
+	}
+}
+
+func TestAppendEncryptedAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector adds allocations")
+	}
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour), WithRecordSize(MaxRecordSize))
+	sub, _, _ := newTestReceiver(t)
+	dst := make([]byte, 0, MaxRecordSize)
+	if _, err := p.AppendEncrypted(dst, message, &sub, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := p.AppendEncrypted(dst, message, &sub, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// The aes and gcm ciphers are allocated by the standard library.
+	if allocs > 2 {
+		t.Fatalf("Too many allocations, expected<=2, got=%v", allocs)
+	}
+}
+
+func TestSendNotificationPooled(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var bodies []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, received{header: r.Header, body: body})
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	for _, encoding := range []ContentEncoding{ContentEncodingAES128GCM, ContentEncodingAESGCM} {
+		t.Run(string(encoding), func(t *testing.T) {
+			bodies = nil
+			p := newTestPusher(t, WithContentEncoding(encoding), WithClient(server.Client()))
+			sub, privateKey, authSecret := newTestReceiver(t)
+			sub.Endpoint = server.URL + "/push"
+
+			messages := make([][]byte, 20)
+			var wg sync.WaitGroup
+			for i := range messages {
+				messages[i] = bytes.Repeat([]byte{byte('a' + i)}, 100+i)
+				wg.Go(func() {
+					sub := sub
+					res, err := p.SendNotification(context.Background(), messages[i], &sub)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					_ = res.Body.Close()
+					if res.StatusCode != http.StatusCreated {
+						t.Errorf("Incorrect status, expected=%d, got=%d", http.StatusCreated, res.StatusCode)
+					}
+				})
+			}
+			wg.Wait()
+
+			// Each message must be received intact, even though the record buffers are reused.
+			seen := make(map[string]bool)
+			for _, r := range bodies {
+				var plaintext []byte
+				var err error
+				if encoding == ContentEncodingAESGCM {
+					plaintext, err = DecryptAESGCMNotification(r.body, r.header, privateKey, authSecret)
+				} else {
+					plaintext, err = DecryptNotification(r.body, privateKey, authSecret)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen[string(plaintext)] = true
+			}
+			for _, m := range messages {
+				if !seen[string(m)] {
+					t.Fatalf("Missing message %q", m[:1])
+				}
+			}
+		})
+	}
+}
+
+func TestRecordBufferRelease(t *testing.T) {
+	buf := getRecordBuffer()
+	record := append(buf.b[:0], "record"...)
+	buf.b = record
+	body, err := buf.body(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.release()
+	// The body still holds a reference.
+	if data, err := io.ReadAll(body); err != nil || string(data) != "record" {
+		t.Fatalf("Incorrect body, expected=%q, got=%q, err=%v", "record", data, err)
+	}
+	_ = body.Close()
+	_ = body.Close()
+	if _, err := body.Read(make([]byte, 1)); !errors.Is(err, http.ErrBodyReadAfterClose) {
+		t.Fatalf("Expected ErrBodyReadAfterClose, got=%v", err)
+	}
+	if _, err := buf.body(record); !errors.Is(err, errRecordReleased) {
+		t.Fatalf("Expected errRecordReleased, got=%v", err)
+	}
+}
+
+func TestReleaseKeyBufZeroization(t *testing.T) {
+	for _, zeroize := range []bool{false, true} {
+		var options []VAPIDPusherOption
+		if zeroize {
+			options = append(options, WithZeroization())
+		}
+		p := newTestPusher(t, options...)
+		keyBuf := getKeyBuf()
+		for i := range keyBuf {
+			keyBuf[i] = 0xff
+		}
+		secret := bytes.Repeat([]byte{0xff}, 32)
+		p.wipe(secret)
+		p.releaseKeyBuf(keyBuf)
+		// The buffer is inspected after being released, only for testing.
+		cleared := bytes.Count(keyBuf[:], []byte{0}) == keyBufLen && bytes.Count(secret, []byte{0}) == len(secret)
+		if cleared != zeroize {
+			t.Fatalf("Incorrect zeroization, expected=%v, got=%v", zeroize, cleared)
+		}
+	}
+}
+
+func TestZeroizationEncrypt(t *testing.T) {
+	for _, encoding := range []ContentEncoding{ContentEncodingAES128GCM, ContentEncodingAESGCM} {
+		t.Run(string(encoding), func(t *testing.T) {
+			p := newTestPusher(t, WithZeroization(), WithContentEncoding(encoding), WithVAPIDTokenTTL(0))
+			sub, privateKey, authSecret := newTestReceiver(t)
+			for range 2 {
+				msg, err := p.EncryptNotification(message, &sub, Options{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var plaintext []byte
+				if encoding == ContentEncodingAESGCM {
+					plaintext, err = DecryptAESGCMNotification(msg.Body, msg.Header, privateKey, authSecret)
+				} else {
+					plaintext, err = DecryptNotification(msg.Body, privateKey, authSecret)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plaintext, message) {
+					t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+				}
+			}
+		})
+	}
+}
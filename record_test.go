@@ -0,0 +1,77 @@
+package fwebpush
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/mawngo/go-fwebpush/ece"
+	"testing"
+)
+
+func TestMultipleRecords(t *testing.T) {
+	large := bytes.Repeat(message, 20)
+	cases := []struct {
+		name       string
+		rs         int
+		message    []byte
+		recordSize int
+	}{
+		{"single", 0, message, 0},
+		{"min rs", ece.MinRS, message, 0},
+		{"rs", 100, message, 0},
+		{"exact", len(message) + ece.RecordOverhead, message, 0},
+		{"exact multiple", len(message)/3 + ece.RecordOverhead, message[:len(message)/3*3], 0},
+		{"empty", 100, []byte{}, 0},
+		{"padding", 100, message, 1024},
+		{"padding not aligned", 100, message, 1000},
+		{"large", 4096, large, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, WithRS(c.rs), WithRecordSize(c.recordSize), WithMaxRecordSize(0))
+			sub, privateKey, authSecret := newTestReceiver(t)
+			body := readRequestBody(t, p, c.message, &sub, Options{})
+
+			if c.rs > 0 {
+				if rs := binary.BigEndian.Uint32(body[rsOffset:]); int(rs) != c.rs {
+					t.Fatalf("Incorrect rs, expected=%d, got=%d", c.rs, rs)
+				}
+			}
+			if c.recordSize > 0 && (len(body) > c.recordSize || len(body) < c.recordSize-ece.RecordOverhead) {
+				t.Fatalf("Incorrect padded size, expected=%d, got=%d", c.recordSize, len(body))
+			}
+			plaintext, err := DecryptNotification(body, privateKey, authSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, c.message) {
+				t.Fatalf("Incorrect plaintext, expected=%q, got=%q", c.message, plaintext)
+			}
+		})
+	}
+}
+
+func TestMultipleRecordsOptions(t *testing.T) {
+	p := newTestPusher(t)
+	sub, privateKey, authSecret := newTestReceiver(t)
+	body := readRequestBody(t, p, message, &sub, Options{RS: 64})
+	if rs := binary.BigEndian.Uint32(body[rsOffset:]); rs != 64 {
+		t.Fatalf("Incorrect rs, expected=%d, got=%d", 64, rs)
+	}
+	records := (len(message) + 64 - ece.RecordOverhead - 1) / (64 - ece.RecordOverhead)
+	if expected := dataOffset + len(message) + records*ece.RecordOverhead; len(body) != expected {
+		t.Fatalf("Incorrect body size, expected=%d, got=%d", expected, len(body))
+	}
+
+	plaintext, err := DecryptNotification(body, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+	}
+
+	// Truncating at a record boundary must be detected by the last record delimiter.
+	if _, err := DecryptNotification(body[:dataOffset+64], privateKey, authSecret); err == nil {
+		t.Fatal("Expected error decrypting truncated records")
+	}
+}
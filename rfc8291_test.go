@@ -0,0 +1,163 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// Example from RFC8291 Appendix A.
+// https://datatracker.ietf.org/doc/html/rfc8291#appendix-A
+const (
+	rfc8291Plaintext        = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivateKey     = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291ASPublicKey      = "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8"
+	rfc8291UAPrivateKey     = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291UAPublicKey      = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Salt             = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291AuthSecret       = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291IKM              = "S4lYMb_L0FxCeq0WhDx813KgSYqU26kOyzWUdsXYyrg"
+	rfc8291EncryptedMessage = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecodeBase64(t testing.TB, s string) []byte {
+	b, err := decodeBase64(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newRFC8291Pusher(t testing.TB, options ...VAPIDPusherOption) (*VAPIDPusher, Subscription) {
+	localPrivateKey, err := ecdh.P256().NewPrivateKey(mustDecodeBase64(t, rfc8291ASPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeBase64String(localPrivateKey.PublicKey().Bytes()) != rfc8291ASPublicKey {
+		t.Fatal("Incorrect application server public key")
+	}
+	vapidPrivateKey, vapidPublicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options = append([]VAPIDPusherOption{
+		WithRandReader(bytes.NewReader(mustDecodeBase64(t, rfc8291Salt))),
+		WithLocalPrivateKey(localPrivateKey),
+	}, options...)
+	p, err := NewVAPIDPusher("test@test.com", vapidPublicKey, vapidPrivateKey, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := Subscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Keys: Keys{
+			Auth:   rfc8291AuthSecret,
+			P256dh: rfc8291UAPublicKey,
+		},
+	}
+	return p, sub
+}
+
+func TestRFC8291Encrypt(t *testing.T) {
+	p, sub := newRFC8291Pusher(t, WithLocalSecretTTL(time.Hour))
+	body := readRequestBody(t, p, []byte(rfc8291Plaintext), &sub, Options{})
+	if encoded := encodeBase64String(body); encoded != rfc8291EncryptedMessage {
+		t.Fatalf("Incorrect encrypted message, expected=%s, got=%s", rfc8291EncryptedMessage, encoded)
+	}
+	if sub.LocalKey == nil || sub.LocalKey.IKM != rfc8291IKM {
+		t.Fatalf("Incorrect IKM, expected=%s, got=%+v", rfc8291IKM, sub.LocalKey)
+	}
+	if sub.LocalKey.Public != rfc8291ASPublicKey {
+		t.Fatalf("Incorrect local public key, expected=%s, got=%s", rfc8291ASPublicKey, sub.LocalKey.Public)
+	}
+}
+
+func TestRFC8291EncryptCachedLocalKey(t *testing.T) {
+	p, sub := newRFC8291Pusher(t, WithLocalSecretTTL(time.Hour))
+	sub.LocalKey = &LocalKey{
+		Public: rfc8291ASPublicKey,
+		IKM:    rfc8291IKM,
+		At:     time.Now().UnixMilli(),
+	}
+	body := readRequestBody(t, p, []byte(rfc8291Plaintext), &sub, Options{})
+	if encoded := encodeBase64String(body); encoded != rfc8291EncryptedMessage {
+		t.Fatalf("Incorrect encrypted message, expected=%s, got=%s", rfc8291EncryptedMessage, encoded)
+	}
+}
+
+func TestRFC8291Decrypt(t *testing.T) {
+	privateKey, err := ecdh.P256().NewPrivateKey(mustDecodeBase64(t, rfc8291UAPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeBase64String(privateKey.PublicKey().Bytes()) != rfc8291UAPublicKey {
+		t.Fatal("Incorrect user agent public key")
+	}
+	plaintext, err := DecryptNotification(mustDecodeBase64(t, rfc8291EncryptedMessage), privateKey, mustDecodeBase64(t, rfc8291AuthSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != rfc8291Plaintext {
+		t.Fatalf("Incorrect plaintext, expected=%q, got=%q", rfc8291Plaintext, plaintext)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	payloadSigner, err := NewPayloadSigner("key", generateVAPIDHeaderKeys(mustDecodeBase64(t, rfc8291IKM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDeterministicPusher := func(options ...VAPIDPusherOption) *VAPIDPusher {
+		random := rand.NewChaCha8([32]byte{1})
+		vapidPrivateKey, vapidPublicKey, err := GenerateVAPIDKeysFrom(random)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewVAPIDPusher("test@test.com", vapidPublicKey, vapidPrivateKey, append(options, WithRandReader(random))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	sub := getURLEncodedTestSubscription()
+	now := time.Unix(1700000000, 0)
+
+	var tokens []string
+	var bodies [][]byte
+	var envelopes [][]byte
+	for range 2 {
+		p := newDeterministicPusher()
+		token, _, err := p.doGetVAPIDToken(&p.vapid, "https://updates.push.services.mozilla.com", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := newDeterministicPusher(WithPayloadSigner(payloadSigner)).signPayload(message, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, envelope)
+		req, err := p.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+		bodies = append(bodies, body)
+	}
+	if tokens[0] != tokens[1] {
+		t.Fatalf("Token is not deterministic, got=%s and %s", tokens[0], tokens[1])
+	}
+	if !bytes.Equal(envelopes[0], envelopes[1]) {
+		t.Fatal("Payload signature is not deterministic")
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) {
+		t.Fatal("Encrypted message is not deterministic")
+	}
+}
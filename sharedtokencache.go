@@ -0,0 +1,104 @@
+package fwebpush
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// VAPIDToken is a signed VAPID JWT token.
+type VAPIDToken struct {
+	Token  string    `json:"t"`
+	Expiry time.Time `json:"e"`
+}
+
+// TokenCache is a cache of VAPID tokens shared across processes, so that replicas sending with the same VAPID key pair
+// reuse the same token for an audience instead of each signing its own.
+// Implementations must be safe for concurrent use.
+//
+// The pusher keeps caching the tokens in process (see [WithVAPIDTokenCacheSize]), the shared cache is only consulted
+// when the token is missing or about to expire. See [WithTokenCache].
+//
+// The tokens are shared by VAPID public key, subject (the sub claim) and audience, so the pushers using the same key pair
+// with different subjects do not send each other tokens. A shared token expiring after the token TTL of the pusher
+// (see [WithVAPIDTokenTTL]) is ignored.
+type TokenCache interface {
+	// Load returns the token signed by the VAPID public key (base64 encoded) with the subject for an audience,
+	// false if not found.
+	Load(publicKey string, subject string, audience string) (VAPIDToken, bool, error)
+	// Store saves the token signed by the VAPID public key with the subject for an audience,
+	// replacing the existing one.
+	Store(publicKey string, subject string, audience string, token VAPIDToken) error
+}
+
+// loadSharedToken returns the shared token of an audience if it expires after minExp, or the zero value.
+// A token expiring after the token TTL of the pusher, signed by a pusher with a longer one, is ignored.
+// The errors of the shared cache are ignored, the token is then signed by the pusher.
+func (p *VAPIDPusher) loadSharedToken(vapid *vapidIdentity, aud string, now time.Time, minExp time.Time) VAPIDToken {
+	if p.tokenCache == nil {
+		return VAPIDToken{}
+	}
+	token, ok, err := p.tokenCache.Load(vapid.publicKey, p.subject, aud)
+	if err != nil || !ok || token.Token == "" || !minExp.Before(token.Expiry) {
+		return VAPIDToken{}
+	}
+	if token.Expiry.After(now.Add(p.vapidTokenTTL + p.vapidTTLBuffer)) {
+		return VAPIDToken{}
+	}
+	return token
+}
+
+// storeSharedToken shares the token signed by the pusher, if any. The errors of the shared cache are ignored.
+func (p *VAPIDPusher) storeSharedToken(vapid *vapidIdentity, aud string, token VAPIDToken) {
+	if p.tokenCache == nil || token.Token == "" {
+		return
+	}
+	_ = p.tokenCache.Store(vapid.publicKey, p.subject, aud, token)
+}
+
+// TokenKV is the minimal key-value store contract required by [KVTokenCache], such as Redis or Memcached.
+type TokenKV interface {
+	// Get returns the value of a key, false if not found or expired.
+	Get(key string) ([]byte, bool, error)
+	// Set saves the value of a key, expiring after the ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// KVTokenCache is a [TokenCache] backed by a key-value store.
+// The tokens are stored as json, under the key <prefix><public key>:<subject>:<audience>, expiring with the token.
+type KVTokenCache struct {
+	kv     TokenKV
+	prefix string
+}
+
+// NewKVTokenCache creates a token cache storing the tokens in the key-value store, with the keys prefixed by prefix.
+func NewKVTokenCache(kv TokenKV, prefix string) *KVTokenCache {
+	return &KVTokenCache{kv: kv, prefix: prefix}
+}
+
+func (c *KVTokenCache) Load(publicKey string, subject string, audience string) (VAPIDToken, bool, error) {
+	value, ok, err := c.kv.Get(c.key(publicKey, subject, audience))
+	if err != nil || !ok {
+		return VAPIDToken{}, false, err
+	}
+	var token VAPIDToken
+	if err := json.Unmarshal(value, &token); err != nil {
+		return VAPIDToken{}, false, err
+	}
+	return token, true, nil
+}
+
+func (c *KVTokenCache) Store(publicKey string, subject string, audience string, token VAPIDToken) error {
+	ttl := time.Until(token.Expiry)
+	if ttl <= 0 {
+		return nil
+	}
+	value, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return c.kv.Set(c.key(publicKey, subject, audience), value, ttl)
+}
+
+func (c *KVTokenCache) key(publicKey string, subject string, audience string) string {
+	return c.prefix + publicKey + ":" + subject + ":" + audience
+}
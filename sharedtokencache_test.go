@@ -0,0 +1,199 @@
+package fwebpush
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryTokenKV is an in-memory stand-in of a key-value store.
+type memoryTokenKV struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	ttls   map[string]time.Duration
+	err    error
+}
+
+func newMemoryTokenKV() *memoryTokenKV {
+	return &memoryTokenKV{values: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (kv *memoryTokenKV) Get(key string) ([]byte, bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.err != nil {
+		return nil, false, kv.err
+	}
+	value, ok := kv.values[key]
+	return value, ok, nil
+}
+
+func (kv *memoryTokenKV) Set(key string, value []byte, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.err != nil {
+		return kv.err
+	}
+	kv.values[key] = value
+	kv.ttls[key] = ttl
+	return nil
+}
+
+func newTestReplicas(t testing.TB, n int, cache TokenCache, options ...VAPIDPusherOption) []*VAPIDPusher {
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := make([]*VAPIDPusher, n)
+	for i := range replicas {
+		replicas[i], err = NewVAPIDPusher("test@test.com", publicKey, privateKey, append(options, WithTokenCache(cache))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return replicas
+}
+
+func TestKVTokenCache(t *testing.T) {
+	kv := newMemoryTokenKV()
+	replicas := newTestReplicas(t, 2, NewKVTokenCache(kv, "webpush:"))
+	sub, _, _ := newTestReceiver(t)
+	now := time.Now()
+
+	first, err := replicas[0].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.values) != 1 {
+		t.Fatalf("Expected the token to be shared, got=%d", len(kv.values))
+	}
+	for key, ttl := range kv.ttls {
+		if expected := "webpush:" + replicas[0].vapid.publicKey + ":mailto:test@test.com:https://updates.push.services.mozilla.com"; key != expected {
+			t.Fatalf("Incorrect key, expected=%s, got=%s", expected, key)
+		}
+		if ttl <= time.Hour || ttl > 70*time.Minute {
+			t.Fatalf("Incorrect ttl %s", ttl)
+		}
+	}
+
+	// The other replica reuses the shared token, with its own local key pair.
+	second, err := replicas[1].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.vapid != first.vapid || !second.exp.Equal(first.exp) {
+		t.Fatal("Expected the shared token to be used")
+	}
+	if second.localPrivateKey == first.localPrivateKey {
+		t.Fatal("Expected a local key pair per replica")
+	}
+
+	// The shared token about to expire is replaced.
+	renewed, err := replicas[1].getCachedKeys(sub.Endpoint, now.Add(61*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.vapid == first.vapid {
+		t.Fatal("Expected a new token")
+	}
+	again, err := replicas[0].getCachedKeys(sub.Endpoint, now.Add(61*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.vapid != renewed.vapid {
+		t.Fatal("Expected the renewed shared token to be used")
+	}
+}
+
+func TestKVTokenCacheScope(t *testing.T) {
+	kv := newMemoryTokenKV()
+	replicas := newTestReplicas(t, 4, NewKVTokenCache(kv, ""))
+	replicas[1].subject = "mailto:other@test.com"
+	replicas[2].vapidTokenTTL = 2 * time.Hour
+	sub, _, _ := newTestReceiver(t)
+	now := time.Now()
+
+	first, err := replicas[0].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replica with another subject signs its own token.
+	other, err := replicas[1].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.vapid == first.vapid || len(kv.values) != 2 {
+		t.Fatalf("Expected a token per subject, got=%d", len(kv.values))
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(getTokenFromAuthorizationHeader(other.vapid, t), claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "mailto:other@test.com" {
+		t.Fatalf("Incorrect subject, got=%v", claims["sub"])
+	}
+
+	// The token of the replica with a longer TTL is not used by the others.
+	longer, err := replicas[2].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longer.vapid != first.vapid {
+		t.Fatal("Expected the shorter shared token to be used")
+	}
+	// Renewed by the replica with a longer TTL, once the first token is about to expire.
+	later := now.Add(62 * time.Minute)
+	renewed, err := replicas[2].getCachedKeys(sub.Endpoint, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := replicas[3].getCachedKeys(sub.Endpoint, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.vapid == first.vapid || shared.vapid == renewed.vapid || shared.exp.After(later.Add(replicas[3].vapidTokenTTL+replicas[3].vapidTTLBuffer)) {
+		t.Fatalf("Expected the longer shared token to be ignored, got exp=%s", shared.exp)
+	}
+}
+
+func TestKVTokenCacheRefresher(t *testing.T) {
+	replicas := newTestReplicas(t, 2, NewKVTokenCache(newMemoryTokenKV(), ""))
+	sub, _, _ := newTestReceiver(t)
+	now := time.Now()
+	for _, p := range replicas {
+		if _, err := p.getCachedKeys(sub.Endpoint, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options := TokenRefresherOptions{Lead: 5 * time.Minute, HotWindow: time.Hour}
+	var renewed []string
+	for _, p := range replicas {
+		if err := p.refreshTokens(now.Add(56*time.Minute), options); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := p.getCachedKeys(sub.Endpoint, now.Add(61*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		renewed = append(renewed, keys.vapid)
+	}
+	if renewed[0] != renewed[1] {
+		t.Fatal("Expected the token renewed by the first replica to be shared")
+	}
+}
+
+func TestKVTokenCacheFailure(t *testing.T) {
+	kv := newMemoryTokenKV()
+	kv.err = errors.New("unavailable")
+	p := newTestReplicas(t, 1, NewKVTokenCache(kv, ""))[0]
+	sub, privateKey, authSecret := newTestReceiver(t)
+	msg, err := p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptNotification(msg.Body, privateKey, authSecret); err != nil {
+		t.Fatal(err)
+	}
+}
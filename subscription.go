@@ -0,0 +1,251 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/mawngo/go-fwebpush/fastunsafeurl"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+// ParsedSubscription is a [Subscription] with decoded and validated keys,
+// which skips the decoding when sending repeatedly to the same subscription.
+// It is immutable and safe for concurrent use.
+type ParsedSubscription struct {
+	endpoint        string
+	audience        string
+	publicKey       *ecdh.PublicKey
+	p256dh          [p256dhLen]byte
+	auth            [authSecretLen]byte
+	localKey        parsedLocalKey
+	localKeyLoaded  bool // Whether the local key store was already checked.
+	contentEncoding ContentEncoding
+	vapidKeyID      string
+}
+
+// parsedLocalKey is a decoded [LocalKey].
+type parsedLocalKey struct {
+	public    [localPublicKeyLen]byte
+	ikm       [32]byte
+	at        int64
+	set       bool
+	sealed    bool // Whether the ikm is still sealed in sealedIKM, see [LocalKeyRing].
+	keyID     string
+	sealedIKM [sealedIKMLen]byte
+}
+
+// ParseSubscription decodes and validates the keys of a subscription.
+// The LocalKey is also decoded if it has an IKM, its expiration is checked when sending,
+// and a sealed IKM is opened when sending using the [LocalKeyRing] of the pusher.
+func ParseSubscription(sub Subscription) (*ParsedSubscription, error) {
+	ps := &ParsedSubscription{
+		endpoint:        sub.Endpoint,
+		contentEncoding: sub.ContentEncoding,
+		vapidKeyID:      sub.VAPIDKeyID,
+	}
+	if err := ps.parseAudience(); err != nil {
+		return nil, errors.Join(ErrInvalidSubscription, err)
+	}
+	if err := ps.parseKeys(sub.Keys); err != nil {
+		return nil, errors.Join(ErrInvalidSubscription, err)
+	}
+	if sub.LocalKey.hasIKM() {
+		if err := ps.localKey.parse(sub.LocalKey); err != nil {
+			return nil, errors.Join(ErrInvalidSubscription, err)
+		}
+	}
+	return ps, nil
+}
+
+// WithLocalKey returns a copy of the parsed subscription using the local key,
+// usually the one returned by the local secret caching.
+func (s *ParsedSubscription) WithLocalKey(localKey *LocalKey) (*ParsedSubscription, error) {
+	ps := *s
+	ps.localKey = parsedLocalKey{}
+	ps.localKeyLoaded = false
+	if localKey.hasIKM() {
+		if err := ps.localKey.parse(localKey); err != nil {
+			return nil, errors.Join(ErrInvalidSubscription, err)
+		}
+	}
+	return &ps, nil
+}
+
+// Endpoint returns the push service endpoint of the subscription.
+func (s *ParsedSubscription) Endpoint() string {
+	return s.endpoint
+}
+
+// Audience returns the origin of the endpoint, which is the audience of the VAPID token.
+func (s *ParsedSubscription) Audience() string {
+	return s.audience
+}
+
+// PublicKey returns the user agent public key (Keys.P256dh).
+func (s *ParsedSubscription) PublicKey() *ecdh.PublicKey {
+	return s.publicKey
+}
+
+// Auth returns a copy of the decoded auth secret (Keys.Auth).
+func (s *ParsedSubscription) Auth() []byte {
+	return bytes.Clone(s.auth[:])
+}
+
+// ContentEncoding returns the content encoding supported by the user agent, if set.
+func (s *ParsedSubscription) ContentEncoding() ContentEncoding {
+	return s.contentEncoding
+}
+
+// VAPIDKeyID returns the ID of the VAPID key pair the subscription was created with, if set.
+func (s *ParsedSubscription) VAPIDKeyID() string {
+	return s.vapidKeyID
+}
+
+func (s *ParsedSubscription) parseAudience() error {
+	aud, _, err := fastunsafeurl.ParseSchemeHost(s.endpoint)
+	if err != nil {
+		return fmt.Errorf("error parsing audience: %w", err)
+	}
+	s.audience = aud
+	return nil
+}
+
+func (s *ParsedSubscription) parseKeys(keys Keys) error {
+	if err := s.decodeKeys(keys); err != nil {
+		return err
+	}
+	// Copy into a local buffer, so s does not escape through the curve interface.
+	p256dh := s.p256dh
+	publicKey, err := ecdh.P256().NewPublicKey(p256dh[:])
+	if err != nil {
+		return err
+	}
+	s.publicKey = publicKey
+	return nil
+}
+
+// decodeKeys decodes the subscription keys, without validating the public key.
+func (s *ParsedSubscription) decodeKeys(keys Keys) error {
+	if err := decodeBase64Buff(keys.Auth, s.auth[:]); err != nil {
+		return err
+	}
+	return decodeBase64Buff(keys.P256dh, s.p256dh[:])
+}
+
+// keysFingerprint returns the fingerprint of the decoded subscription keys, see [LocalKey.Fingerprint].
+func (s *ParsedSubscription) keysFingerprint() string {
+	var keys [p256dhLen + authSecretLen]byte
+	copy(keys[:], s.p256dh[:])
+	copy(keys[p256dhLen:], s.auth[:])
+	sum := sha256.Sum256(keys[:])
+	return encodeBase64String(sum[:16])
+}
+
+// parse decodes the local key, a sealed IKM is decoded but not opened.
+func (k *parsedLocalKey) parse(localKey *LocalKey) error {
+	if err := decodeBase64Buff(localKey.Public, k.public[:]); err != nil {
+		return err
+	}
+	if localKey.SealedIKM != "" {
+		if err := decodeBase64Buff(localKey.SealedIKM, k.sealedIKM[:]); err != nil {
+			return err
+		}
+		k.keyID = localKey.KeyID
+		k.sealed = true
+	} else if err := decodeBase64Buff(localKey.IKM, k.ikm[:]); err != nil {
+		return err
+	}
+	k.at = localKey.At
+	k.set = true
+	return nil
+}
+
+// parseSubscription decodes the subscription keys required to encrypt a message.
+// The keys are not decoded if the local key, from the subscription or the store, can be reused.
+func (p *VAPIDPusher) parseSubscription(sub *Subscription, options Options, now time.Time) (ParsedSubscription, error) {
+	ps := ParsedSubscription{
+		endpoint:        sub.Endpoint,
+		contentEncoding: sub.ContentEncoding,
+		vapidKeyID:      sub.VAPIDKeyID,
+	}
+	if err := ps.parseAudience(); err != nil {
+		return ps, err
+	}
+	if p.localSecretTTLFn != nil && p.resolveContentEncoding(sub.ContentEncoding, options) == ContentEncodingAES128GCM {
+		if lk := sub.LocalKey; lk.hasIKM() {
+			if p.isLocalKeyFresh(lk.At, now) {
+				if err := ps.localKey.parse(lk); err != nil {
+					return ps, errors.Join(ErrEncryption, err)
+				}
+				if err := p.openLocalKey(&ps.localKey); err != nil {
+					return ps, errors.Join(ErrEncryption, err)
+				}
+				return ps, nil
+			}
+		} else if p.localKeyStore != nil {
+			if err := ps.decodeKeys(sub.Keys); err != nil {
+				return ps, errors.Join(ErrEncryption, err)
+			}
+			localKey, err := p.loadLocalKey(sub.Endpoint, ps.keysFingerprint())
+			if err != nil {
+				return ps, err
+			}
+			ps.localKey, ps.localKeyLoaded = localKey, true
+			if localKey.set && p.isLocalKeyFresh(localKey.at, now) {
+				return ps, nil
+			}
+		}
+	}
+	if err := ps.parseKeys(sub.Keys); err != nil {
+		return ps, errors.Join(ErrEncryption, err)
+	}
+	return ps, nil
+}
+
+// isLocalKeyFresh returns whether a local key created at the specified unix milliseconds can be reused.
+func (p *VAPIDPusher) isLocalKeyFresh(at int64, now time.Time) bool {
+	return p.localSecretTTLFn != nil && at > now.Add(-p.localSecretTTLFn()).UnixMilli()
+}
+
+// SendParsedNotification sends a push notification to a parsed subscription's endpoint.
+// The parsed subscription is never modified, so the local key generated by the local secret caching is not saved,
+// use [VAPIDPusher.EncryptParsedNotification] to retrieve it.
+func (p *VAPIDPusher) SendParsedNotification(ctx context.Context, message []byte, sub *ParsedSubscription, options Options) (*http.Response, error) {
+	buf := getRecordBuffer()
+	defer buf.release()
+	msg, err := p.encryptNotification(buf.b[:0], message, sub, options, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	buf.b = msg.Body
+	req, err := msg.newRequest(ctx, buf)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.Do(req)
+}
+
+// EncryptParsedNotification encrypts a push notification for a parsed subscription, without sending it.
+// See [VAPIDPusher.EncryptNotification].
+func (p *VAPIDPusher) EncryptParsedNotification(message []byte, sub *ParsedSubscription, options Options) (EncryptedMessage, error) {
+	return p.encryptNotification(nil, message, sub, options, time.Now())
+}
+
+// VAPIDHeadersParsed returns the VAPID headers of a parsed subscription.
+// See [VAPIDPusher.VAPIDHeaders].
+func (p *VAPIDPusher) VAPIDHeadersParsed(sub *ParsedSubscription) (http.Header, error) {
+	return p.vapidHeaders(sub, time.Now())
+}
+
+// AppendEncryptedParsed encrypts the message for a parsed subscription, and appends the encrypted body to dst.
+// The local key is returned if a new one is generated by the local secret caching.
+// See [VAPIDPusher.AppendEncrypted].
+func (p *VAPIDPusher) AppendEncryptedParsed(dst []byte, message []byte, sub *ParsedSubscription, options Options) ([]byte, *LocalKey, error) {
+	return p.appendEncryptedParsed(dst, message, sub, options, time.Now())
+}
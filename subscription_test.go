@@ -0,0 +1,178 @@
+package fwebpush
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSubscription(t *testing.T) {
+	sub, privateKey, authSecret := newTestReceiver(t)
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Endpoint() != sub.Endpoint {
+		t.Fatalf("Incorrect endpoint, expected=%s, got=%s", sub.Endpoint, parsed.Endpoint())
+	}
+	if parsed.Audience() != "https://updates.push.services.mozilla.com" {
+		t.Fatalf("Incorrect audience, got=%s", parsed.Audience())
+	}
+	if !parsed.PublicKey().Equal(privateKey.PublicKey()) {
+		t.Fatal("Incorrect public key")
+	}
+	if !bytes.Equal(parsed.Auth(), authSecret) {
+		t.Fatalf("Incorrect auth, expected=%x, got=%x", authSecret, parsed.Auth())
+	}
+
+	for _, encoding := range []ContentEncoding{ContentEncodingAES128GCM, ContentEncodingAESGCM} {
+		t.Run(string(encoding), func(t *testing.T) {
+			p := newTestPusher(t, WithContentEncoding(encoding))
+			msg, err := p.EncryptParsedNotification(message, parsed, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var plaintext []byte
+			if encoding == ContentEncodingAESGCM {
+				plaintext, err = DecryptAESGCMNotification(msg.Body, msg.Header, privateKey, authSecret)
+			} else {
+				plaintext, err = DecryptNotification(msg.Body, privateKey, authSecret)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, message) {
+				t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+			}
+		})
+	}
+}
+
+func TestParseSubscriptionLocalKey(t *testing.T) {
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	body := readRequestBody(t, p, message, &sub, Options{})
+	if sub.LocalKey == nil {
+		t.Fatal("local key not generated")
+	}
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := p.AppendEncryptedParsed(nil, message, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The local public key (keyid) is reused.
+	if !bytes.Equal(out[localPublicKeyOffset:dataOffset], body[localPublicKeyOffset:dataOffset]) {
+		t.Fatal("Expected the local key to be reused")
+	}
+	plaintext, err := DecryptNotification(out, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+	}
+}
+
+func TestParseSubscriptionInvalid(t *testing.T) {
+	valid, _, _ := newTestReceiver(t)
+	cases := []struct {
+		name   string
+		modify func(sub *Subscription)
+	}{
+		{"endpoint", func(sub *Subscription) { sub.Endpoint = "invalid" }},
+		{"auth", func(sub *Subscription) { sub.Keys.Auth = "invalid" }},
+		{"p256dh", func(sub *Subscription) { sub.Keys.P256dh = sub.Keys.Auth }},
+		{"p256dh not on curve", func(sub *Subscription) {
+			sub.Keys.P256dh = encodeBase64String(append([]byte{4}, make([]byte, 64)...))
+		}},
+		{"local key", func(sub *Subscription) { sub.LocalKey = &LocalKey{Public: "invalid", IKM: "invalid"} }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sub := valid
+			c.modify(&sub)
+			if _, err := ParseSubscription(sub); !errors.Is(err, ErrInvalidSubscription) {
+				t.Fatalf("Expected ErrInvalidSubscription, got=%v", err)
+			}
+		})
+	}
+}
+
+// Concurrent encryption for the same subscription must not race, the generated local key is returned instead.
+func TestEncryptNotificationConcurrent(t *testing.T) {
+	p := newTestPusher(t, WithLocalSecretTTL(time.Hour))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	localKeys := make(chan *LocalKey, 40)
+	for range 20 {
+		wg.Go(func() {
+			msg, err := p.EncryptNotification(message, &sub, Options{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			localKeys <- msg.LocalKey
+			if _, err := DecryptNotification(msg.Body, privateKey, authSecret); err != nil {
+				t.Error(err)
+			}
+		})
+		wg.Go(func() {
+			msg, err := p.EncryptParsedNotification(message, parsed, Options{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			localKeys <- msg.LocalKey
+			if _, err := DecryptNotification(msg.Body, privateKey, authSecret); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	close(localKeys)
+	if sub.LocalKey != nil {
+		t.Fatal("Expected the subscription to not be modified")
+	}
+
+	// The returned local key can be reused.
+	var localKey *LocalKey
+	for lk := range localKeys {
+		if lk == nil {
+			t.Fatal("Expected a local key to be generated")
+		}
+		localKey = lk
+	}
+	sub.LocalKey = localKey
+	msg, err := p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.LocalKey != nil {
+		t.Fatal("Expected the local key to be reused")
+	}
+	parsed, err = parsed.WithLocalKey(localKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = p.EncryptParsedNotification(message, parsed, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.LocalKey != nil {
+		t.Fatal("Expected the local key to be reused")
+	}
+	if !bytes.Equal(msg.Body[localPublicKeyOffset:dataOffset], mustDecodeBase64(t, localKey.Public)) {
+		t.Fatal("Incorrect local public key")
+	}
+}
@@ -0,0 +1,177 @@
+package fwebpush
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTokenCacheSize          = 10_000
+	defaultTokenCacheSweepInterval = 10 * time.Minute
+)
+
+// tokenCache is a bounded cache of the VAPID tokens and local key pairs, by key ID and audience.
+// When full, the least recently used entry is evicted, approximated using a second chance list:
+// the hits only record their last use, so they take no lock, and the entries used since they were
+// queued are moved back to the front instead of being evicted, once per use, so the eviction is amortized O(1).
+// The expired entries are swept periodically, when inserting.
+type tokenCache struct {
+	entries sync.Map // vapidCacheKey to *tokenCacheEntry, read without lock.
+
+	mu            sync.Mutex // Guards the writes.
+	capacity      int
+	sweepInterval time.Duration
+	nextSweep     time.Time
+	lru           *list.List // Most recently queued first.
+}
+
+type tokenCacheEntry struct {
+	key      vapidCacheKey
+	auth     atomic.Pointer[reusableKey]
+	lastUsed atomic.Int64 // Unix seconds.
+	queued   int64        // The last use when moved to the front, guarded by the cache lock.
+	elem     *list.Element
+}
+
+func newTokenCache(capacity int, sweepInterval time.Duration) *tokenCache {
+	return &tokenCache{
+		capacity:      max(capacity, 1),
+		sweepInterval: sweepInterval,
+		lru:           list.New(),
+	}
+}
+
+func (c *tokenCache) load(key vapidCacheKey) (*tokenCacheEntry, bool) {
+	v, ok := c.entries.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*tokenCacheEntry), true
+}
+
+// get returns the cached keys, or the zero value if not found, and marks the entry as used.
+// The last use is written at most once per second, so the hits of a hot audience only read shared memory.
+func (c *tokenCache) get(key vapidCacheKey, now time.Time) reusableKey {
+	e, ok := c.load(key)
+	if !ok {
+		return reusableKey{}
+	}
+	unix := now.Unix()
+	for used := e.lastUsed.Load(); used < unix; used = e.lastUsed.Load() {
+		if e.lastUsed.CompareAndSwap(used, unix) {
+			break
+		}
+	}
+	return *e.auth.Load()
+}
+
+// peek returns the cached keys without marking the entry as used.
+func (c *tokenCache) peek(key vapidCacheKey) (reusableKey, bool) {
+	e, ok := c.load(key)
+	if !ok {
+		return reusableKey{}, false
+	}
+	return *e.auth.Load(), true
+}
+
+// put caches the keys, evicting the least recently used entry when full.
+// The entries expiring before expiredBefore are dropped when sweeping.
+func (c *tokenCache) put(key vapidCacheKey, auth reusableKey, now time.Time, expiredBefore time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sweepInterval > 0 && !now.Before(c.nextSweep) {
+		c.sweep(expiredBefore)
+		c.nextSweep = now.Add(c.sweepInterval)
+	}
+	if e, ok := c.load(key); ok {
+		e.auth.Store(&auth)
+		e.lastUsed.Store(now.Unix())
+		e.queued = now.Unix()
+		c.lru.MoveToFront(e.elem)
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		c.evict()
+	}
+	e := &tokenCacheEntry{key: key, queued: now.Unix()}
+	e.auth.Store(&auth)
+	e.lastUsed.Store(now.Unix())
+	e.elem = c.lru.PushFront(e)
+	c.entries.Store(key, e)
+}
+
+// evict drops the least recently used entry, must be called with the lock held.
+// The entries used since they were queued get a second chance, each one at most once per call,
+// when all of them were used the one with the oldest last use is dropped.
+func (c *tokenCache) evict() {
+	var oldest *tokenCacheEntry
+	for range c.lru.Len() {
+		e := c.lru.Back().Value.(*tokenCacheEntry)
+		used := e.lastUsed.Load()
+		if used <= e.queued {
+			oldest = e
+			break
+		}
+		if oldest == nil || used < oldest.queued {
+			oldest = e
+		}
+		e.queued = used
+		c.lru.MoveToFront(e.elem)
+	}
+	c.remove(oldest)
+}
+
+// replace updates the keys of an existing entry, without marking it as used.
+func (c *tokenCache) replace(key vapidCacheKey, auth reusableKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.load(key); ok {
+		e.auth.Store(&auth)
+	}
+}
+
+// sweep drops the entries expiring before expiredBefore, must be called with the lock held.
+func (c *tokenCache) sweep(expiredBefore time.Time) {
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if e := elem.Value.(*tokenCacheEntry); !expiredBefore.Before(e.auth.Load().exp) {
+			c.remove(e)
+		}
+		elem = next
+	}
+}
+
+// remove drops an entry, must be called with the lock held.
+func (c *tokenCache) remove(e *tokenCacheEntry) {
+	c.lru.Remove(e.elem)
+	c.entries.Delete(e.key)
+}
+
+// collect returns the keys of the entries used since the unix seconds usedSince, and expiring before expiredBefore.
+func (c *tokenCache) collect(usedSince int64, expiredBefore time.Time) []vapidCacheKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []vapidCacheKey
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*tokenCacheEntry)
+		if e.lastUsed.Load() >= usedSince && !expiredBefore.Before(e.auth.Load().exp) {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+func (c *tokenCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *tokenCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Clear()
+	c.lru.Init()
+}
@@ -0,0 +1,140 @@
+package fwebpush
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTokenCacheKey(i int) vapidCacheKey {
+	return vapidCacheKey{aud: "https://push" + strconv.Itoa(i) + ".example.com"}
+}
+
+func TestTokenCacheEviction(t *testing.T) {
+	now := time.Now()
+	exp := now.Add(time.Hour)
+	c := newTokenCache(2, 0)
+	c.put(newTestTokenCacheKey(0), reusableKey{vapid: "0", exp: exp}, now, now)
+	c.put(newTestTokenCacheKey(1), reusableKey{vapid: "1", exp: exp}, now.Add(time.Second), now)
+	// The first entry is now the most recently used.
+	if auth := c.get(newTestTokenCacheKey(0), now.Add(2*time.Second)); auth.vapid != "0" {
+		t.Fatalf("Incorrect cached token, expected=0, got=%s", auth.vapid)
+	}
+	c.put(newTestTokenCacheKey(2), reusableKey{vapid: "2", exp: exp}, now.Add(3*time.Second), now)
+	if c.len() != 2 {
+		t.Fatalf("Incorrect size, expected=2, got=%d", c.len())
+	}
+	for i, expected := range []string{"0", "", "2"} {
+		if auth := c.get(newTestTokenCacheKey(i), now); auth.vapid != expected {
+			t.Fatalf("Incorrect cached token %d, expected=%q, got=%q", i, expected, auth.vapid)
+		}
+	}
+
+	// Replacing an entry marks it as used.
+	c.put(newTestTokenCacheKey(2), reusableKey{vapid: "2", exp: exp}, now.Add(4*time.Second), now)
+	c.put(newTestTokenCacheKey(3), reusableKey{vapid: "3", exp: exp}, now.Add(5*time.Second), now)
+	if c.get(newTestTokenCacheKey(0), now).vapid != "" || c.get(newTestTokenCacheKey(2), now).vapid != "2" {
+		t.Fatal("Expected the least recently used entry to be evicted")
+	}
+}
+
+func TestTokenCacheSweep(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache(100, time.Minute)
+	for i := range 10 {
+		c.put(newTestTokenCacheKey(i), reusableKey{exp: now.Add(time.Duration(i) * time.Minute)}, now, now)
+	}
+	if c.len() != 10 {
+		t.Fatalf("Incorrect size, expected=10, got=%d", c.len())
+	}
+	// Not swept before the interval.
+	c.put(newTestTokenCacheKey(10), reusableKey{exp: now.Add(time.Hour)}, now.Add(30*time.Second), now.Add(5*time.Minute))
+	if c.len() != 11 {
+		t.Fatalf("Incorrect size, expected=11, got=%d", c.len())
+	}
+	c.put(newTestTokenCacheKey(11), reusableKey{exp: now.Add(time.Hour)}, now.Add(time.Minute), now.Add(5*time.Minute))
+	// Entries 0 to 5 are expired.
+	if c.len() != 6 {
+		t.Fatalf("Incorrect size, expected=6, got=%d", c.len())
+	}
+}
+
+func TestTokenCachePusher(t *testing.T) {
+	p := newTestPusher(t, WithVAPIDTokenCacheSize(2))
+	for i := range 5 {
+		endpoint := "https://push" + strconv.Itoa(i) + ".example.com/sub"
+		keys, err := p.getCachedKeys(endpoint, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached, err := p.getCachedKeys(endpoint, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached.vapid != keys.vapid {
+			t.Fatal("Expected the token to be cached")
+		}
+	}
+	if p.cache.len() != 2 {
+		t.Fatalf("Incorrect size, expected=2, got=%d", p.cache.len())
+	}
+}
+
+func TestTokenCacheConcurrent(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache(50, time.Millisecond)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Go(func() {
+			for i := range 500 {
+				key := newTestTokenCacheKey((g*31 + i) % 200)
+				at := now.Add(time.Duration(i) * time.Millisecond)
+				c.get(key, at)
+				c.put(key, reusableKey{exp: at.Add(time.Duration(i%3) * time.Millisecond)}, at, at)
+				c.replace(key, reusableKey{exp: at.Add(time.Hour)})
+			}
+		})
+	}
+	wg.Wait()
+	n := 0
+	c.entries.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	if c.len() != n || n > 50 {
+		t.Fatalf("Incorrect size, expected=%d, got=%d", n, c.len())
+	}
+}
+
+func TestTokenCacheCapacity(t *testing.T) {
+	now := time.Now()
+	exp := now.Add(time.Hour)
+	c := newTokenCache(1000, time.Minute)
+	// The audiences fitting in the cache are never evicted, whatever the order of use.
+	for round := range 3 {
+		at := now.Add(time.Duration(round) * time.Second)
+		for i := range 1000 {
+			key := newTestTokenCacheKey((i * (round + 1) * 7) % 1000)
+			if round == 0 {
+				key = newTestTokenCacheKey(i)
+			}
+			if auth := c.get(key, at); auth.vapid == "" {
+				c.put(key, reusableKey{vapid: key.aud, exp: exp}, at, now)
+				if round > 0 {
+					t.Fatalf("Unexpected eviction of %s", key.aud)
+				}
+			}
+		}
+	}
+	if c.len() != 1000 {
+		t.Fatalf("Incorrect size, expected=1000, got=%d", c.len())
+	}
+
+	// A new audience evicts the least recently used one, the others got a second chance.
+	c.get(newTestTokenCacheKey(0), now.Add(time.Minute))
+	c.put(newTestTokenCacheKey(1000), reusableKey{vapid: "new", exp: exp}, now.Add(time.Minute), now)
+	if c.len() != 1000 || c.get(newTestTokenCacheKey(0), now).vapid == "" || c.get(newTestTokenCacheKey(1000), now).vapid != "new" {
+		t.Fatal("Expected a single least recently used entry to be evicted")
+	}
+}
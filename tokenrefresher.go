@@ -0,0 +1,158 @@
+package fwebpush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultTokenRefreshInterval  = time.Minute
+	defaultTokenRefreshHotWindow = 10 * time.Minute
+)
+
+// TokenRefresherOptions configure [VAPIDPusher.RunTokenRefresher].
+type TokenRefresherOptions struct {
+	// Interval between two checks of the cached tokens.
+	// Optional, default 1 minute.
+	Interval time.Duration
+	// Lead is how long before the token would be regenerated when sending (see [WithVAPIDTokenTTLExt]) it is renewed.
+	// Must be less than the token TTL. Optional, default twice the Interval, so a token is checked at least once.
+	Lead time.Duration
+	// HotWindow is how recently a token must have been used to be renewed, the others are regenerated when sending.
+	// Optional, default 10 minutes.
+	HotWindow time.Duration
+	// OnError is called with a [*TokenRefreshError] when a token cannot be renewed.
+	// The token is then regenerated when sending. Optional.
+	OnError func(err error)
+}
+
+// TokenRefreshError is a failure to renew the cached VAPID token of an audience.
+type TokenRefreshError struct {
+	// KeyID is the ID of the VAPID key pair, empty for the pusher key pair.
+	KeyID    string
+	Audience string
+	Err      error
+}
+
+func (e *TokenRefreshError) Error() string {
+	if e.KeyID == "" {
+		return fmt.Sprintf("error refreshing VAPID token of %s: %v", e.Audience, e.Err)
+	}
+	return fmt.Sprintf("error refreshing VAPID token of %s with key %s: %v", e.Audience, e.KeyID, e.Err)
+}
+
+func (e *TokenRefreshError) Unwrap() error {
+	return e.Err
+}
+
+// RunTokenRefresher renews the cached VAPID tokens of the recently used audiences before they expire,
+// so the senders never wait for the token signing. It blocks until the context is done or the pusher is closed,
+// returning the context error or [ErrPusherClosed].
+//
+// The local key pair cached with the token is also renewed, unless it has its own rotation (see [WithLocalKeyRotation]).
+// Requires the VAPID token caching, see [WithVAPIDTokenTTL].
+func (p *VAPIDPusher) RunTokenRefresher(ctx context.Context, options TokenRefresherOptions) error {
+	if !p.IsVapidTokenCachingEnabled() {
+		return errors.New("VAPID token caching is disabled")
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultTokenRefreshInterval
+	}
+	if options.Lead <= 0 {
+		options.Lead = 2 * options.Interval
+	}
+	if options.HotWindow <= 0 {
+		options.HotWindow = defaultTokenRefreshHotWindow
+	}
+	if options.Lead >= p.vapidTokenTTL {
+		return fmt.Errorf("token refresh lead %s must be less than the token TTL %s", options.Lead, p.vapidTokenTTL)
+	}
+
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if err := p.refreshTokens(time.Now(), options); err != nil {
+			return err
+		}
+	}
+}
+
+// refreshTokens renews the hot tokens expiring within the lead, only returning [ErrPusherClosed].
+func (p *VAPIDPusher) refreshTokens(now time.Time, options TokenRefresherOptions) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrPusherClosed
+	}
+	renewBefore := now.Add(p.vapidTTLBuffer + options.Lead)
+	keys := p.cache.collect(now.Add(-options.HotWindow).Unix(), renewBefore)
+	p.mu.RUnlock()
+
+	for _, key := range keys {
+		err := p.refreshToken(key, now, renewBefore)
+		if errors.Is(err, ErrPusherClosed) {
+			return err
+		}
+		if err != nil && options.OnError != nil {
+			options.OnError(&TokenRefreshError{KeyID: key.keyID, Audience: key.aud, Err: err})
+		}
+	}
+	return nil
+}
+
+// refreshToken renews the token of a cache entry, the entry is left unchanged if it was evicted
+// or renewed by the sending meanwhile.
+// A shared token expiring after renewBefore is used instead of signing a new one.
+func (p *VAPIDPusher) refreshToken(key vapidCacheKey, now time.Time, renewBefore time.Time) error {
+	vapid, err := p.resolveVAPIDIdentity(key.keyID, now)
+	if err != nil {
+		return err
+	}
+	var local reusableKey
+	if p.localKeyRotation == 0 {
+		local, err = p.doGenLocalKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	token := p.loadSharedToken(vapid, key.aud, now, renewBefore)
+	if token.Token == "" {
+		// Sign under the read lock, so the senders are not blocked.
+		p.mu.RLock()
+		if p.closed {
+			p.mu.RUnlock()
+			return ErrPusherClosed
+		}
+		token.Token, token.Expiry, err = p.doGetVAPIDToken(vapid, key.aud, now)
+		p.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		p.storeSharedToken(vapid, key.aud, token)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPusherClosed
+	}
+	auth, ok := p.cache.peek(key)
+	if !ok || !auth.exp.Before(token.Expiry) {
+		return nil
+	}
+	p.setAuthorization(&auth, vapid, key.aud, token.Token)
+	auth.exp = token.Expiry
+	if p.localKeyRotation == 0 {
+		auth.curve, auth.localPrivateKey, auth.localPublicKeyBytes = local.curve, local.localPrivateKey, local.localPublicKeyBytes
+	}
+	p.cache.replace(key, auth)
+	return nil
+}
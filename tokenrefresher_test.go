@@ -0,0 +1,122 @@
+package fwebpush
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenRefresher(t *testing.T) {
+	p := newTestPusher(t)
+	options := TokenRefresherOptions{Lead: 5 * time.Minute, HotWindow: 10 * time.Minute}
+	hot := "https://hot.example.com/sub"
+	cold := "https://cold.example.com/sub"
+	now := time.Now()
+	keys := make(map[string]reusableKey)
+	for _, endpoint := range []string{hot, cold} {
+		k, err := p.getCachedKeys(endpoint, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[endpoint] = k
+	}
+
+	// The token is regenerated when sending after 60 minutes, renewed from 55 minutes.
+	if _, err := p.getCachedKeys(hot, now.Add(50*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.refreshTokens(now.Add(50*time.Minute), options); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := p.cache.peek(vapidCacheKey{aud: "https://hot.example.com"}); k.vapid != keys[hot].vapid {
+		t.Fatal("Expected the token to not be renewed before the lead")
+	}
+	if err := p.refreshTokens(now.Add(56*time.Minute), options); err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := p.cache.peek(vapidCacheKey{aud: "https://hot.example.com"})
+	if renewed.vapid == keys[hot].vapid || !renewed.exp.After(keys[hot].exp) {
+		t.Fatal("Expected the hot token to be renewed")
+	}
+	if renewed.localPrivateKey == keys[hot].localPrivateKey {
+		t.Fatal("Expected the local key pair to be renewed with the token")
+	}
+	if k, _ := p.cache.peek(vapidCacheKey{aud: "https://cold.example.com"}); k.vapid != keys[cold].vapid {
+		t.Fatal("Expected the cold token to not be renewed")
+	}
+
+	// The renewed token is used when sending, past the original expiration.
+	k, err := p.getCachedKeys(hot, now.Add(61*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.vapid != renewed.vapid {
+		t.Fatal("Expected the renewed token to be used")
+	}
+}
+
+func TestTokenRefresherError(t *testing.T) {
+	now := time.Now()
+	p := newTestPusher(t, WithVAPIDIdentities(newTestVAPIDIdentity(t, "old", time.Time{}, now.Add(30*time.Minute))))
+	sub, _, _ := newTestReceiver(t)
+	sub.VAPIDKeyID = "old"
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid, err := p.resolveVAPIDIdentity("old", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.getCachedKeysAud(vapid, parsed.Audience(), now.Add(29*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []error
+	options := TokenRefresherOptions{OnError: func(err error) { reported = append(reported, err) }, Lead: 2 * time.Minute, HotWindow: time.Hour}
+	if err := p.refreshTokens(now.Add(88*time.Minute), options); err != nil {
+		t.Fatal(err)
+	}
+	var refreshErr *TokenRefreshError
+	if len(reported) != 1 || !errors.As(reported[0], &refreshErr) || !errors.Is(refreshErr, ErrVAPIDKeyExpired) {
+		t.Fatalf("Expected a TokenRefreshError, got=%v", reported)
+	}
+	if refreshErr.KeyID != "old" || refreshErr.Audience != parsed.Audience() {
+		t.Fatalf("Incorrect TokenRefreshError %+v", refreshErr)
+	}
+	if msg := refreshErr.Error(); !strings.Contains(msg, "key old") || !strings.Contains(msg, parsed.Audience()) {
+		t.Fatalf("Incorrect TokenRefreshError message %s", msg)
+	}
+}
+
+func TestRunTokenRefresher(t *testing.T) {
+	p := newTestPusher(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.RunTokenRefresher(ctx, TokenRefresherOptions{Interval: time.Millisecond})
+	}()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got=%v", err)
+	}
+
+	go func() {
+		done <- p.RunTokenRefresher(context.Background(), TokenRefresherOptions{Interval: time.Millisecond})
+	}()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrPusherClosed) {
+		t.Fatalf("Expected ErrPusherClosed, got=%v", err)
+	}
+
+	if err := newTestPusher(t, WithVAPIDTokenTTL(0)).RunTokenRefresher(context.Background(), TokenRefresherOptions{}); err == nil {
+		t.Fatal("Expected error when the token caching is disabled")
+	}
+	if err := newTestPusher(t).RunTokenRefresher(context.Background(), TokenRefresherOptions{Lead: time.Hour}); err == nil {
+		t.Fatal("Expected error when the lead exceeds the token TTL")
+	}
+}
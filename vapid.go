@@ -10,6 +10,7 @@
 	"fmt"
 	"github.com/mawngo/go-fwebpush/fastunsafeurl"
 	jwt2 "github.com/mawngo/go-fwebpush/internal/jwt"
+	"io"
 	"math/big"
 	"time"
 )
@@ -19,16 +20,29 @@ func (p *VAPIDPusher) getCachedKeys(endpoint string, now time.Time) (reusableKey
 	if err != nil {
 		return reusableKey{}, fmt.Errorf("error parsing audience: %w", err)
 	}
+	return p.getCachedKeysAud(&p.vapid, aud, now)
+}
+
+// getCachedKeysAud returns the VAPID token of a key pair and the local key pair of an audience.
+func (p *VAPIDPusher) getCachedKeysAud(vapid *vapidIdentity, aud string, now time.Time) (reusableKey, error) {
 	// Cache disabled.
 	if p.vapidTokenTTL <= 0 {
 		auth, err := p.doGenLocalKey()
 		if err != nil {
 			return reusableKey{}, err
 		}
-		auth.vapid, auth.exp, err = p.doGetVAPIDAuthorizationHeader(aud, now)
+		// Prevent closing while signing.
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if p.closed {
+			return reusableKey{}, ErrPusherClosed
+		}
+		var token string
+		token, auth.exp, err = p.doGetVAPIDToken(vapid, aud, now)
 		if err != nil {
 			return reusableKey{}, err
 		}
+		p.setAuthorization(&auth, vapid, aud, token)
 		return auth, nil
 	}
 
@@ -36,37 +50,88 @@ func (p *VAPIDPusher) getCachedKeys(endpoint string, now time.Time) (reusableKey
 	// So the min-acceptable expiration should be <additional time> after now.
 	nowExp := now.Add(p.vapidTTLBuffer)
 	// Most of the time code will run into this path.
-	// Cache hit, not expired, use cached vapid.
-	p.mu.RLock()
-	if auth := p.cache[aud]; nowExp.Before(auth.exp) {
-		p.mu.RUnlock()
-		return auth, nil
+	// Cache hit, not expired, use cached vapid without the pusher lock.
+	key := vapidCacheKey{keyID: vapid.id, aud: aud}
+	auth := p.cache.get(key, now)
+	if !nowExp.Before(auth.exp) || !p.isCachedLocalKeyValid(auth, now) {
+		// Load the token shared by other processes outside the lock.
+		var shared VAPIDToken
+		if !nowExp.Before(auth.exp) {
+			shared = p.loadSharedToken(vapid, aud, now, nowExp)
+		}
+		var signed VAPIDToken
+		var err error
+		auth, signed, err = p.refreshCachedKeys(vapid, key, now, nowExp, shared)
+		if err != nil {
+			return reusableKey{}, err
+		}
+		p.storeSharedToken(vapid, aud, signed)
 	}
-	p.mu.RUnlock()
 
+	// Per message local key, only the token is cached.
+	if p.localKeyRotation < 0 {
+		local, err := p.doGenLocalKey()
+		if err != nil {
+			return reusableKey{}, err
+		}
+		auth.curve, auth.localPrivateKey, auth.localPublicKeyBytes = local.curve, local.localPrivateKey, local.localPublicKeyBytes
+	}
+	return auth, nil
+}
+
+// refreshCachedKeys regenerates the expired token and local key pair of a key pair and audience.
+// The shared token is used instead of signing a new one if not expired, the signed token is returned to be shared.
+func (p *VAPIDPusher) refreshCachedKeys(vapid *vapidIdentity, key vapidCacheKey, now time.Time, nowExp time.Time, shared VAPIDToken) (reusableKey, VAPIDToken, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if p.closed {
+		return reusableKey{}, VAPIDToken{}, ErrPusherClosed
+	}
 	// Someone else has written to the cache.
-	if auth := p.cache[aud]; nowExp.Before(auth.exp) {
-		return auth, nil
+	auth := p.cache.get(key, now)
+	tokenValid := nowExp.Before(auth.exp)
+	localKeyValid := p.isCachedLocalKeyValid(auth, now)
+	if tokenValid && localKeyValid {
+		return auth, VAPIDToken{}, nil
 	}
-	auth, err := p.doGenLocalKey()
-	if err != nil {
-		return reusableKey{}, err
+
+	// The local key pair is rotated with the token, unless it has its own rotation.
+	if (!tokenValid && p.localKeyRotation == 0) || !localKeyValid {
+		local, err := p.doGenLocalKey()
+		if err != nil {
+			return reusableKey{}, VAPIDToken{}, err
+		}
+		auth.curve, auth.localPrivateKey, auth.localPublicKeyBytes = local.curve, local.localPrivateKey, local.localPublicKeyBytes
+		auth.localExp = now.Add(p.localKeyRotation)
 	}
-	auth.vapid, auth.exp, err = p.doGetVAPIDAuthorizationHeader(aud, now)
-	if err != nil {
-		return reusableKey{}, err
+	var signed VAPIDToken
+	if !tokenValid {
+		if !nowExp.Before(shared.Expiry) {
+			var err error
+			shared.Token, shared.Expiry, err = p.doGetVAPIDToken(vapid, key.aud, now)
+			if err != nil {
+				return reusableKey{}, VAPIDToken{}, err
+			}
+			signed = shared
+		}
+		p.setAuthorization(&auth, vapid, key.aud, shared.Token)
+		auth.exp = shared.Expiry
 	}
-	p.cache[aud] = auth
-	return auth, nil
+	p.cache.put(key, auth, now, nowExp)
+	return auth, signed, nil
 }
 
-func (p *VAPIDPusher) doGetVAPIDAuthorizationHeader(aud string, now time.Time) (string, time.Time, error) {
+// isCachedLocalKeyValid returns whether the cached local key pair does not need its own rotation.
+func (p *VAPIDPusher) isCachedLocalKeyValid(auth reusableKey, now time.Time) bool {
+	return p.localKeyRotation <= 0 || now.Before(auth.localExp)
+}
+
+// doGetVAPIDToken signs a VAPID JWT token for the audience.
+func (p *VAPIDPusher) doGetVAPIDToken(vapid *vapidIdentity, aud string, now time.Time) (string, time.Time, error) {
 	// Always expire at least <additional time> (so the message won't expire when it reached the server).
 	exp := now.Add(p.vapidTokenTTL + p.vapidTTLBuffer)
-	privKey := generateVAPIDHeaderKeys(p.vapidPrivateKey)
-	signer, err := jwt2.NewSignerES(jwt2.ES256, privKey)
+	privKey := generateVAPIDHeaderKeys(vapid.privateKey)
+	signer, err := jwt2.NewSignerESRand(jwt2.ES256, privKey, p.signingRand())
 	if err != nil {
 		return "", exp, err
 	}
@@ -76,18 +141,38 @@ func (p *VAPIDPusher) doGetVAPIDAuthorizationHeader(aud string, now time.Time) (
 		ExpiresAt: exp.Unix(),
 	}
 	token, err := jwt2.NewBuilder(signer).Build(claims)
+	if p.zeroize {
+		clear(privKey.D.Bits())
+	}
 	if err != nil {
 		return "", exp, err
 	}
-	return "vapid t=" + token.String() + p.vapidPublicKeyHeaderPart, exp, nil
+	return token.String(), exp, nil
+}
+
+// signingRand returns the random source of the ECDSA signatures, nil for deterministic signatures.
+// The standard library ignores custom random sources when signing,
+// so fallback to deterministic signature to make the signature reproducible.
+func (p *VAPIDPusher) signingRand() io.Reader {
+	if p.randReader == rand.Reader {
+		return rand.Reader
+	}
+	return nil
 }
 
 func (p *VAPIDPusher) doGenLocalKey() (reusableKey, error) {
 	curve := ecdh.P256()
 	// Application server key pairs (single use).
-	localPrivateKey, err := curve.GenerateKey(rand.Reader)
-	if err != nil {
-		return reusableKey{}, errors.Join(ErrEncryption, err)
+	localPrivateKey := p.localPrivateKey
+	if localPrivateKey == nil && p.localKeyPool != nil {
+		localPrivateKey = p.localKeyPool.get()
+	}
+	if localPrivateKey == nil {
+		var err error
+		localPrivateKey, err = generateKey(curve, p.randReader)
+		if err != nil {
+			return reusableKey{}, errors.Join(ErrEncryption, err)
+		}
 	}
 	localPublicKeyBytes := localPrivateKey.PublicKey().Bytes()
 	return reusableKey{
@@ -99,10 +184,16 @@ func (p *VAPIDPusher) doGenLocalKey() (reusableKey, error) {
 
 // GenerateVAPIDKeys will create a private and public VAPID key pair.
 func GenerateVAPIDKeys() (privateKey, publicKey string, err error) {
+	return GenerateVAPIDKeysFrom(rand.Reader)
+}
+
+// GenerateVAPIDKeysFrom will create a private and public VAPID key pair using the provided random source.
+// Useful for reproducible keys in tests.
+func GenerateVAPIDKeysFrom(random io.Reader) (privateKey, publicKey string, err error) {
 	// Get the private key from the P256 curve
 	curve := ecdh.P256()
 
-	private, err := curve.GenerateKey(rand.Reader)
+	private, err := generateKey(curve, random)
 	if err != nil {
 		return
 	}
@@ -114,6 +205,26 @@ func GenerateVAPIDKeys() (privateKey, publicKey string, err error) {
 	return
 }
 
+// generateKey generates a private key using the random source.
+// The standard library ignores custom random sources (since go 1.26),
+// so the scalar is sampled from the random source unless it is the default crypto/rand.Reader.
+func generateKey(curve ecdh.Curve, random io.Reader) (*ecdh.PrivateKey, error) {
+	if random == rand.Reader {
+		return curve.GenerateKey(random)
+	}
+	scalar := make([]byte, 32)
+	// Rejection sampling, the probability of a scalar out of range is negligible for P-256.
+	for range 100 {
+		if _, err := io.ReadFull(random, scalar); err != nil {
+			return nil, err
+		}
+		if key, err := curve.NewPrivateKey(scalar); err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("failed to generate private key")
+}
+
 // Generates the ECDSA public and private keys for the JWT encryption.
 func generateVAPIDHeaderKeys(privateKey []byte) *ecdsa.PrivateKey {
 	// Public key
@@ -143,10 +254,12 @@ func generateVAPIDHeaderKeys(privateKey []byte) *ecdsa.PrivateKey {
 // reusableKey is used to cache the VAPID reusable keys and token.
 // Does not modify this struct outside this file.
 type reusableKey struct {
-	vapid string
+	vapid     string // Authorization header.
+	cryptoKey string // Crypto-Key header of the legacy VAPID scheme, see [VAPIDSchemeWebPush].
 
 	curve               ecdh.Curve
 	localPrivateKey     *ecdh.PrivateKey
 	localPublicKeyBytes []byte
 	exp                 time.Time
+	localExp            time.Time // Rotation of the local key pair, only used with [WithLocalKeyRotation].
 }
@@ -1,7 +1,9 @@
 package fwebpush
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"strings"
@@ -138,6 +140,71 @@ func TestVAPIDCacheExpired(t *testing.T) {
 	}
 }
 
+func TestLocalKeyRotation(t *testing.T) {
+	s := getStandardEncodedTestSubscription()
+	now := time.Now()
+	cases := []struct {
+		name    string
+		option  VAPIDPusherOption
+		after   time.Duration
+		rotated bool
+	}{
+		{"default", WithLocalKeyRotation(0), 30 * time.Minute, false},
+		{"default expired", WithLocalKeyRotation(0), 65 * time.Minute, true},
+		{"interval", WithLocalKeyRotation(time.Minute), 30 * time.Second, false},
+		{"interval expired", WithLocalKeyRotation(time.Minute), 2 * time.Minute, true},
+		{"per message", WithPerMessageLocalKey(), 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, WithVAPIDTokenTTL(time.Hour), c.option)
+			keys, err := p.getCachedKeys(s.Endpoint, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, err := p.getCachedKeys(s.Endpoint, now.Add(c.after))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated := !next.localPrivateKey.Equal(keys.localPrivateKey); rotated != c.rotated {
+				t.Fatalf("Incorrect local key rotation, expected=%v, got=%v", c.rotated, rotated)
+			}
+			// The token is still cached, unless it expires.
+			if tokenRotated := next.vapid != keys.vapid; tokenRotated != (c.after > time.Hour) {
+				t.Fatalf("Incorrect token rotation, expected=%v, got=%v", c.after > time.Hour, tokenRotated)
+			}
+		})
+	}
+}
+
+func TestVAPIDPusherClose(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Hour, 0} {
+		t.Run(ttl.String(), func(t *testing.T) {
+			p := newTestPusher(t, WithVAPIDTokenTTL(ttl))
+			sub, _, _ := newTestReceiver(t)
+			if _, err := p.EncryptNotification(message, &sub, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			vapidPrivateKey := p.vapid.privateKey
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Count(vapidPrivateKey, []byte{0}) != len(vapidPrivateKey) || p.vapid.privateKey != nil {
+				t.Fatal("Expected the VAPID private key to be wiped")
+			}
+			if p.cache.len() != 0 {
+				t.Fatal("Expected the cache to be dropped")
+			}
+			if _, err := p.EncryptNotification(message, &sub, Options{}); !errors.Is(err, ErrPusherClosed) {
+				t.Fatalf("Expected ErrPusherClosed, got=%v", err)
+			}
+		})
+	}
+}
+
 func TestVAPIDKeys(t *testing.T) {
 	privateKey, publicKey, err := GenerateVAPIDKeys()
 	if err != nil {
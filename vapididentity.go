@@ -0,0 +1,129 @@
+package fwebpush
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnknownVAPIDKey = errors.New("unknown VAPID key")
+var ErrVAPIDKeyExpired = errors.New("VAPID key expired")
+
+// VAPIDIdentity is an additional VAPID (application server) key pair, see [WithVAPIDIdentities].
+type VAPIDIdentity struct {
+	// ID of the key pair, recorded in Subscription.VAPIDKeyID. Must not be empty.
+	ID string
+	// PublicKey is the base64 encoded VAPID public key, the applicationServerKey of the subscription.
+	PublicKey string
+	// PrivateKey is the base64 encoded VAPID private key.
+	PrivateKey string
+	// NotBefore is the time from which the key pair is used for new subscriptions, see [VAPIDPusher.ApplicationServerKey].
+	// Optional, zero means always.
+	NotBefore time.Time
+	// NotAfter is the time from which the key pair is retired, sending fails with [ErrVAPIDKeyExpired].
+	// Optional, zero means never.
+	NotAfter time.Time
+}
+
+// vapidIdentity is a decoded [VAPIDIdentity].
+// Only the private key is modified after creation, by [VAPIDPusher.Close] under the pusher lock.
+type vapidIdentity struct {
+	id                  string
+	publicKey           string // VAPID public key, passed in the Crypto-Key header of the legacy encoding.
+	publicKeyHeaderPart string // VAPID public key passed in the VAPID Authorization header (format: `, k=<key`).
+	privateKey          []byte // VAPID private key, used to sign VAPID JWT token.
+	notBefore           time.Time
+	notAfter            time.Time
+}
+
+// newVAPIDIdentity decodes the key pair, checking that the public key matches the private key.
+func newVAPIDIdentity(identity VAPIDIdentity) (*vapidIdentity, error) {
+	if err := ValidateVAPIDKeys(identity.PrivateKey, identity.PublicKey); err != nil {
+		return nil, err
+	}
+	privateKey, err := decodeBase64(identity.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyBytes, err := decodeBase64(identity.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := encodeBase64String(publicKeyBytes)
+	return &vapidIdentity{
+		id:                  identity.ID,
+		publicKey:           publicKey,
+		publicKeyHeaderPart: ", k=" + publicKey,
+		privateKey:          privateKey,
+		notBefore:           identity.NotBefore,
+		notAfter:            identity.NotAfter,
+	}, nil
+}
+
+// authorization returns the RFC8292 VAPID Authorization header of a token signed by the key pair.
+func (k *vapidIdentity) authorization(token string) string {
+	return "vapid t=" + token + k.publicKeyHeaderPart
+}
+
+// isExpired returns whether the key pair is retired.
+func (k *vapidIdentity) isExpired(now time.Time) bool {
+	return !k.notAfter.IsZero() && !now.Before(k.notAfter)
+}
+
+// parseVAPIDIdentities decodes the additional key pairs configured by [WithVAPIDIdentities].
+func (p *VAPIDPusher) parseVAPIDIdentities(identities []VAPIDIdentity) error {
+	if len(identities) == 0 {
+		return nil
+	}
+	p.vapidIdentities = make(map[string]*vapidIdentity, len(identities))
+	for _, identity := range identities {
+		if identity.ID == "" {
+			return errors.New("empty VAPID key ID")
+		}
+		if _, ok := p.vapidIdentities[identity.ID]; ok {
+			return fmt.Errorf("duplicate VAPID key ID %q", identity.ID)
+		}
+		if !identity.NotAfter.IsZero() && !identity.NotBefore.Before(identity.NotAfter) {
+			return fmt.Errorf("empty validity window for VAPID key %q", identity.ID)
+		}
+		k, err := newVAPIDIdentity(identity)
+		if err != nil {
+			return fmt.Errorf("invalid VAPID key %q: %w", identity.ID, err)
+		}
+		p.vapidIdentities[identity.ID] = k
+	}
+	return nil
+}
+
+// resolveVAPIDIdentity returns the key pair a subscription was created with,
+// the pusher key pair if the subscription has no key ID.
+func (p *VAPIDPusher) resolveVAPIDIdentity(keyID string, now time.Time) (*vapidIdentity, error) {
+	if keyID == "" {
+		return &p.vapid, nil
+	}
+	k, ok := p.vapidIdentities[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%q %w", keyID, ErrUnknownVAPIDKey)
+	}
+	if k.isExpired(now) {
+		return nil, fmt.Errorf("%q %w", keyID, ErrVAPIDKeyExpired)
+	}
+	return k, nil
+}
+
+// ApplicationServerKey returns the key ID and the base64 encoded public key that new subscriptions should use,
+// which is the not expired key pair with the latest NotBefore, the pusher key pair (with an empty ID) on ties.
+// The key ID must be saved to Subscription.VAPIDKeyID once subscribed.
+func (p *VAPIDPusher) ApplicationServerKey(now time.Time) (keyID string, publicKey string) {
+	current := &p.vapid
+	for _, k := range p.vapidIdentities {
+		if now.Before(k.notBefore) || k.isExpired(now) {
+			continue
+		}
+		// Other ties are broken by ID, so the result does not depend on the map order.
+		if k.notBefore.After(current.notBefore) || (k.notBefore.Equal(current.notBefore) && current != &p.vapid && k.id > current.id) {
+			current = k
+		}
+	}
+	return current.id, current.publicKey
+}
@@ -0,0 +1,256 @@
+package fwebpush
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestVAPIDIdentity(t testing.TB, id string, notBefore, notAfter time.Time) VAPIDIdentity {
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VAPIDIdentity{ID: id, PublicKey: publicKey, PrivateKey: privateKey, NotBefore: notBefore, NotAfter: notAfter}
+}
+
+// verifyVAPIDToken checks that the Authorization header is signed by the identity.
+func verifyVAPIDToken(t *testing.T, header string, identity VAPIDIdentity) {
+	t.Helper()
+	if k := headerParam(header, "k"); k != identity.PublicKey {
+		t.Fatalf("Incorrect VAPID public key, expected=%s, got=%s", identity.PublicKey, k)
+	}
+	privateKey, err := decodeBase64(identity.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.Parse(getTokenFromAuthorizationHeader(header, t), func(token *jwt.Token) (any, error) {
+		return generateVAPIDHeaderKeys(privateKey).Public(), nil
+	})
+	if err != nil {
+		t.Fatalf("Invalid VAPID token: %v", err)
+	}
+}
+
+func TestVAPIDIdentities(t *testing.T) {
+	defaultIdentity := newTestVAPIDIdentity(t, "", time.Time{}, time.Time{})
+	next := newTestVAPIDIdentity(t, "next", time.Time{}, time.Time{})
+	p, err := NewVAPIDPusher("test@test.com", defaultIdentity.PublicKey, defaultIdentity.PrivateKey, WithVAPIDIdentities(next))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identity := range []VAPIDIdentity{defaultIdentity, next} {
+		sub, privateKey, authSecret := newTestReceiver(t)
+		sub.VAPIDKeyID = identity.ID
+		msg, err := p.EncryptNotification(message, &sub, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyVAPIDToken(t, msg.Header.Get("Authorization"), identity)
+
+		// Parsed subscriptions keep the key ID.
+		parsed, err := ParseSubscription(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.VAPIDKeyID() != identity.ID {
+			t.Fatalf("Incorrect key ID, expected=%s, got=%s", identity.ID, parsed.VAPIDKeyID())
+		}
+		parsedMsg, err := p.EncryptParsedNotification(message, parsed, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedMsg.Header.Get("Authorization") != msg.Header.Get("Authorization") {
+			t.Fatal("Expected the cached token to be reused")
+		}
+
+		// The legacy encoding passes the public key in the Crypto-Key header.
+		req, err := p.PrepareNotificationRequest(t.Context(), message, &sub, Options{ContentEncoding: ContentEncodingAESGCM})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := headerParam(req.Header.Get("Crypto-Key"), "p256ecdsa"); key != identity.PublicKey {
+			t.Fatalf("Incorrect Crypto-Key p256ecdsa, expected=%s, got=%s", identity.PublicKey, key)
+		}
+		plaintext, err := DecryptNotification(msg.Body, privateKey, authSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+		}
+	}
+	if p.cache.len() != 2 {
+		t.Fatalf("Expected a cached token per key pair, got=%d", p.cache.len())
+	}
+}
+
+func TestVAPIDIdentitiesUnavailable(t *testing.T) {
+	now := time.Now()
+	p := newTestPusher(t, WithVAPIDIdentities(newTestVAPIDIdentity(t, "old", time.Time{}, now.Add(-time.Minute))))
+	cases := []struct {
+		keyID string
+		err   error
+	}{
+		{"unknown", ErrUnknownVAPIDKey},
+		{"old", ErrVAPIDKeyExpired},
+	}
+	for _, c := range cases {
+		t.Run(c.keyID, func(t *testing.T) {
+			sub, _, _ := newTestReceiver(t)
+			sub.VAPIDKeyID = c.keyID
+			if _, err := p.EncryptNotification(message, &sub, Options{}); !errors.Is(err, c.err) {
+				t.Fatalf("Expected %v, got=%v", c.err, err)
+			}
+			parsed, err := ParseSubscription(sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := p.AppendEncryptedParsed(nil, message, parsed, Options{}); !errors.Is(err, c.err) {
+				t.Fatalf("Expected %v, got=%v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestApplicationServerKey(t *testing.T) {
+	now := time.Now()
+	retired := newTestVAPIDIdentity(t, "retired", time.Time{}, now)
+	current := newTestVAPIDIdentity(t, "current", now.Add(-time.Hour), time.Time{})
+	upcoming := newTestVAPIDIdentity(t, "upcoming", now.Add(time.Hour), time.Time{})
+
+	p := newTestPusher(t)
+	if id, publicKey := p.ApplicationServerKey(now); id != "" || publicKey != p.vapid.publicKey {
+		t.Fatalf("Expected the pusher key pair, got=%s", id)
+	}
+	p = newTestPusher(t, WithVAPIDIdentities(retired, current, upcoming))
+	cases := []struct {
+		at       time.Time
+		expected VAPIDIdentity
+	}{
+		{now, current},
+		{now.Add(time.Hour), upcoming},
+	}
+	for _, c := range cases {
+		if id, publicKey := p.ApplicationServerKey(c.at); id != c.expected.ID || publicKey != c.expected.PublicKey {
+			t.Fatalf("Incorrect application server key, expected=%s, got=%s", c.expected.ID, id)
+		}
+	}
+	// Identities without NotBefore do not replace the pusher key pair.
+	p = newTestPusher(t, WithVAPIDIdentities(newTestVAPIDIdentity(t, "legacy", time.Time{}, time.Time{})))
+	if id, _ := p.ApplicationServerKey(now); id != "" {
+		t.Fatalf("Expected the pusher key pair, got=%s", id)
+	}
+}
+
+func TestVAPIDIdentitiesInvalid(t *testing.T) {
+	now := time.Now()
+	valid := newTestVAPIDIdentity(t, "a", time.Time{}, time.Time{})
+	invalidKey := valid
+	invalidKey.PrivateKey = "%"
+	cases := []struct {
+		name       string
+		identities []VAPIDIdentity
+	}{
+		{"empty id", []VAPIDIdentity{newTestVAPIDIdentity(t, "", time.Time{}, time.Time{})}},
+		{"duplicate id", []VAPIDIdentity{valid, valid}},
+		{"empty window", []VAPIDIdentity{newTestVAPIDIdentity(t, "b", now, now)}},
+		{"invalid key", []VAPIDIdentity{invalidKey}},
+	}
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewVAPIDPusher("test@test.com", publicKey, privateKey, WithVAPIDIdentities(c.identities...)); err == nil {
+				t.Fatal("Expected error")
+			}
+		})
+	}
+}
+
+func TestVAPIDIdentitiesClose(t *testing.T) {
+	p := newTestPusher(t, WithVAPIDIdentities(newTestVAPIDIdentity(t, "a", time.Time{}, time.Time{})))
+	privateKey := p.vapidIdentities["a"].privateKey
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(privateKey, []byte{0}) != len(privateKey) || p.vapidIdentities["a"].privateKey != nil {
+		t.Fatal("Expected the VAPID private key to be wiped")
+	}
+	sub, _, _ := newTestReceiver(t)
+	sub.VAPIDKeyID = "a"
+	if _, err := p.EncryptNotification(message, &sub, Options{}); !errors.Is(err, ErrPusherClosed) {
+		t.Fatalf("Expected ErrPusherClosed, got=%v", err)
+	}
+}
+
+func TestVAPIDHeaders(t *testing.T) {
+	next := newTestVAPIDIdentity(t, "next", time.Time{}, time.Time{})
+	p := newTestPusher(t, WithVAPIDIdentities(next))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	sub.VAPIDKeyID = next.ID
+
+	var received http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	record, err := p.AppendEncrypted(nil, message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := p.VAPIDHeaders(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, server.URL, bytes.NewReader(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Encoding", string(ContentEncodingAES128GCM))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	// Signed by the key pair of the subscription, not the pusher key pair.
+	verifyVAPIDToken(t, received.Get("Authorization"), next)
+	plaintext, err := DecryptNotification(body, privateKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+	}
+
+	parsed, err := ParseSubscription(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedHeader, err := p.VAPIDHeadersParsed(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedHeader.Get("Authorization") != header.Get("Authorization") {
+		t.Fatal("Expected the cached token to be reused")
+	}
+
+	sub.VAPIDKeyID = "unknown"
+	if _, err := p.VAPIDHeaders(&sub); !errors.Is(err, ErrUnknownVAPIDKey) {
+		t.Fatalf("Expected ErrUnknownVAPIDKey, got=%v", err)
+	}
+}
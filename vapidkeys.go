@@ -0,0 +1,230 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidVAPIDKey = errors.New("invalid VAPID key")
+var ErrVAPIDKeyMismatch = errors.New("VAPID public key does not match the private key")
+
+// vapidJWK is a P-256 JSON Web Key (RFC 7517).
+type vapidJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+// vapidKeyFile is the key file of the web-push Node library (web-push generate-vapid-keys --json).
+type vapidKeyFile struct {
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// ParseVAPIDKeys parses a VAPID key pair in any supported format: PEM (see [ParseVAPIDKeysPEM]),
+// JWK (see [ParseVAPIDKeysJWK]) or the web-push Node library key file (see [ParseVAPIDKeysJSON]).
+// The keys are returned base64 encoded, as accepted by [NewVAPIDPusher].
+func ParseVAPIDKeys(data []byte) (privateKey, publicKey string, err error) {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("-----BEGIN")):
+		return ParseVAPIDKeysPEM(data)
+	case bytes.Contains(data, []byte(`"kty"`)):
+		return ParseVAPIDKeysJWK(data)
+	}
+	return ParseVAPIDKeysJSON(data)
+}
+
+// ParseVAPIDKeysPEM parses a PEM encoded P-256 private key, either PKCS#8 ("PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY"),
+// and returns the base64 encoded key pair.
+// Other PEM blocks, like the "EC PARAMETERS" written by openssl, are skipped.
+func ParseVAPIDKeysPEM(data []byte) (privateKey, publicKey string, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", "", fmt.Errorf("no private key PEM block %w", ErrInvalidVAPIDKey)
+		}
+		var key any
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return "", "", errors.Join(ErrInvalidVAPIDKey, err)
+		}
+		ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", "", fmt.Errorf("unsupported key type %T %w", key, ErrInvalidVAPIDKey)
+		}
+		ecdhKey, err := ecdsaKey.ECDH()
+		if err != nil || ecdhKey.Curve() != ecdh.P256() {
+			return "", "", fmt.Errorf("unsupported curve, only P-256 is supported %w", ErrInvalidVAPIDKey)
+		}
+		return encodeBase64String(ecdhKey.Bytes()), encodeBase64String(ecdhKey.PublicKey().Bytes()), nil
+	}
+}
+
+// ParseVAPIDKeysJWK parses a P-256 private JSON Web Key, including "d", and returns the base64 encoded key pair.
+// The public key ("x" and "y") must match the private key.
+func ParseVAPIDKeysJWK(data []byte) (privateKey, publicKey string, err error) {
+	var jwk vapidJWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return "", "", errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return "", "", fmt.Errorf("unsupported key %s %s, only EC P-256 is supported %w", jwk.Kty, jwk.Crv, ErrInvalidVAPIDKey)
+	}
+	if jwk.D == "" {
+		return "", "", fmt.Errorf("missing private key %w", ErrInvalidVAPIDKey)
+	}
+	var x, y [32]byte
+	if err := decodeBase64Buff(jwk.X, x[:]); err != nil {
+		return "", "", fmt.Errorf("invalid x %w", ErrInvalidVAPIDKey)
+	}
+	if err := decodeBase64Buff(jwk.Y, y[:]); err != nil {
+		return "", "", fmt.Errorf("invalid y %w", ErrInvalidVAPIDKey)
+	}
+	public := make([]byte, 0, 65)
+	public = append(public, 4)
+	public = append(public, x[:]...)
+	public = append(public, y[:]...)
+	privateKey, publicKey = jwk.D, encodeBase64String(public)
+	if err := ValidateVAPIDKeys(privateKey, publicKey); err != nil {
+		return "", "", err
+	}
+	return privateKey, publicKey, nil
+}
+
+// ParseVAPIDKeysJSON parses the key file of the web-push Node library ({"publicKey": ..., "privateKey": ...}),
+// and returns the base64 encoded key pair. The public key must match the private key.
+func ParseVAPIDKeysJSON(data []byte) (privateKey, publicKey string, err error) {
+	var file vapidKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", "", errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	if err := ValidateVAPIDKeys(file.PrivateKey, file.PublicKey); err != nil {
+		return "", "", err
+	}
+	return file.PrivateKey, file.PublicKey, nil
+}
+
+// ValidateVAPIDKeys checks that the base64 encoded key pair is a valid P-256 key pair,
+// and that the public key matches the private key.
+func ValidateVAPIDKeys(privateKey, publicKey string) error {
+	key, err := decodeVAPIDPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	public, err := decodeBase64(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key %w", ErrInvalidVAPIDKey)
+	}
+	if !bytes.Equal(key.PublicKey().Bytes(), public) {
+		return ErrVAPIDKeyMismatch
+	}
+	return nil
+}
+
+// EncodeVAPIDKeysPEM encodes the base64 encoded VAPID private key as a PKCS#8 PEM block.
+func EncodeVAPIDKeysPEM(privateKey string) ([]byte, error) {
+	key, err := decodeVAPIDPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncodeVAPIDKeysSEC1PEM encodes the base64 encoded VAPID private key as a SEC 1 ("EC PRIVATE KEY") PEM block,
+// as written by openssl ecparam -genkey.
+func EncodeVAPIDKeysSEC1PEM(privateKey string) ([]byte, error) {
+	key, err := decodeVAPIDPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), key.Bytes())
+	if err != nil {
+		return nil, errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncodeVAPIDKeysJWK encodes the base64 encoded VAPID private key as a private JSON Web Key.
+func EncodeVAPIDKeysJWK(privateKey string) ([]byte, error) {
+	key, err := decodeVAPIDPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	public := key.PublicKey().Bytes()
+	return json.Marshal(vapidJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   encodeBase64String(public[1:33]),
+		Y:   encodeBase64String(public[33:]),
+		D:   encodeBase64String(key.Bytes()),
+	})
+}
+
+// EncodeVAPIDKeysJSON encodes the base64 encoded VAPID private key as a web-push Node library key file.
+func EncodeVAPIDKeysJSON(privateKey string) ([]byte, error) {
+	key, err := decodeVAPIDPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(vapidKeyFile{
+		PublicKey:  encodeBase64String(key.PublicKey().Bytes()),
+		PrivateKey: encodeBase64String(key.Bytes()),
+	})
+}
+
+// NewVAPIDPusherFromKeys creates a pusher from a VAPID key pair in any format supported by [ParseVAPIDKeys].
+func NewVAPIDPusherFromKeys(subject string, data []byte, options ...VAPIDPusherOption) (*VAPIDPusher, error) {
+	privateKey, publicKey, err := ParseVAPIDKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewVAPIDPusher(subject, publicKey, privateKey, options...)
+}
+
+// vapidPrivateKeyLen is the length of a P-256 private key scalar.
+const vapidPrivateKeyLen = 32
+
+// decodeVAPIDPrivateKey decodes and validates the big-endian P-256 scalar of a VAPID private key.
+// Shorter scalars, whose leading zero bytes were stripped, are left-padded as the previous versions accepted them.
+func decodeVAPIDPrivateKey(privateKey string) (*ecdh.PrivateKey, error) {
+	b, err := decodeBase64(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %w", ErrInvalidVAPIDKey)
+	}
+	if len(b) > vapidPrivateKeyLen {
+		return nil, fmt.Errorf("invalid private key length %w", ErrInvalidVAPIDKey)
+	}
+	var scalar [vapidPrivateKeyLen]byte
+	copy(scalar[vapidPrivateKeyLen-len(b):], b)
+	key, err := ecdh.P256().NewPrivateKey(scalar[:])
+	if err != nil {
+		return nil, errors.Join(ErrInvalidVAPIDKey, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,185 @@
+package fwebpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVAPIDKeysFormats(t *testing.T) {
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), mustDecodeBase64(t, privateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8PEM, err := EncodeVAPIDKeysPEM(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1PEM, err := EncodeVAPIDKeysSEC1PEM(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := EncodeVAPIDKeysJWK(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := EncodeVAPIDKeysJSON(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		data  []byte
+		parse func([]byte) (string, string, error)
+	}{
+		{"pkcs8", pkcs8PEM, ParseVAPIDKeysPEM},
+		// As written by openssl ecparam -genkey.
+		{"sec1", append(pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{6, 8, 42, 134, 72, 206, 61, 3, 1, 7}}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})...), ParseVAPIDKeysPEM},
+		{"sec1 encoded", sec1PEM, ParseVAPIDKeysPEM},
+		{"jwk", jwk, ParseVAPIDKeysJWK},
+		{"json", keyFile, ParseVAPIDKeysJSON},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, parse := range []func([]byte) (string, string, error){c.parse, ParseVAPIDKeys} {
+				parsedPrivateKey, parsedPublicKey, err := parse(c.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if parsedPrivateKey != privateKey || parsedPublicKey != publicKey {
+					t.Fatalf("Incorrect key pair, expected=%s:%s, got=%s:%s", privateKey, publicKey, parsedPrivateKey, parsedPublicKey)
+				}
+			}
+		})
+	}
+}
+
+func TestVAPIDKeysMismatch(t *testing.T) {
+	privateKey, _, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPublicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateVAPIDKeys(privateKey, otherPublicKey); !errors.Is(err, ErrVAPIDKeyMismatch) {
+		t.Fatalf("Expected ErrVAPIDKeyMismatch, got=%v", err)
+	}
+	if _, err := NewVAPIDPusher("test@test.com", otherPublicKey, privateKey); !errors.Is(err, ErrVAPIDKeyMismatch) {
+		t.Fatalf("Expected ErrVAPIDKeyMismatch, got=%v", err)
+	}
+	keyFile := []byte(`{"publicKey":"` + otherPublicKey + `","privateKey":"` + privateKey + `"}`)
+	if _, _, err := ParseVAPIDKeysJSON(keyFile); !errors.Is(err, ErrVAPIDKeyMismatch) {
+		t.Fatalf("Expected ErrVAPIDKeyMismatch, got=%v", err)
+	}
+	other := mustDecodeBase64(t, otherPublicKey)
+	jwk := []byte(`{"kty":"EC","crv":"P-256","x":"` + encodeBase64String(other[1:33]) + `","y":"` + encodeBase64String(other[33:]) + `","d":"` + privateKey + `"}`)
+	if _, _, err := ParseVAPIDKeysJWK(jwk); !errors.Is(err, ErrVAPIDKeyMismatch) {
+		t.Fatalf("Expected ErrVAPIDKeyMismatch, got=%v", err)
+	}
+}
+
+func TestVAPIDKeysInvalid(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(p384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := mustDecodeBase64(t, publicKey)
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"p384", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})},
+		{"no private key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})},
+		{"jwk without d", []byte(`{"kty":"EC","crv":"P-256","x":"` + encodeBase64String(public[1:33]) + `","y":"` + encodeBase64String(public[33:]) + `"}`)},
+		{"jwk rsa", []byte(`{"kty":"RSA","n":"AQAB","e":"AQAB"}`)},
+		{"json", []byte(`{"publicKey":"` + publicKey + `"}`)},
+		{"garbage", []byte("garbage")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, err := ParseVAPIDKeys(c.data); !errors.Is(err, ErrInvalidVAPIDKey) {
+				t.Fatalf("Expected ErrInvalidVAPIDKey, got=%v", err)
+			}
+		})
+	}
+}
+
+func TestVAPIDKeysScalarLength(t *testing.T) {
+	// A scalar with a leading zero byte, stripped by some encoders.
+	scalar := make([]byte, 32)
+	if _, err := rand.Read(scalar[1:]); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := VAPIDIdentity{PublicKey: encodeBase64String(key.PublicKey().Bytes()), PrivateKey: encodeBase64String(scalar)}
+	stripped := encodeBase64String(scalar[1:])
+	if err := ValidateVAPIDKeys(stripped, identity.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewVAPIDPusher("test@test.com", identity.PublicKey, stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := p.getCachedKeys("https://updates.push.services.mozilla.com/wpush/v2/gAAAAA", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyVAPIDToken(t, keys.vapid, identity)
+
+	for _, invalid := range [][]byte{append([]byte{0}, scalar...), bytes.Repeat([]byte{0xff}, 32), {}} {
+		if err := ValidateVAPIDKeys(encodeBase64String(invalid), identity.PublicKey); !errors.Is(err, ErrInvalidVAPIDKey) {
+			t.Fatalf("Expected ErrInvalidVAPIDKey for %x, got=%v", invalid, err)
+		}
+	}
+}
+
+func TestNewVAPIDPusherFromKeys(t *testing.T) {
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeVAPIDKeysPEM(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewVAPIDPusherFromKeys("test@test.com", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, _ := newTestReceiver(t)
+	msg, err := p.EncryptNotification(message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyVAPIDToken(t, msg.Header.Get("Authorization"), VAPIDIdentity{PublicKey: publicKey, PrivateKey: privateKey})
+}
@@ -0,0 +1,61 @@
+package fwebpush
+
+import (
+	"net/http"
+	"strings"
+)
+
+// VAPIDScheme is the scheme of the Authorization header carrying the VAPID token.
+type VAPIDScheme string
+
+const (
+	VAPIDSchemeUnset VAPIDScheme = ""
+	// VAPIDSchemeVAPID is the RFC8292 scheme (default): `Authorization: vapid t=<token>, k=<key>`.
+	VAPIDSchemeVAPID VAPIDScheme = "vapid"
+	// VAPIDSchemeWebPush is the legacy scheme from draft-ietf-webpush-vapid-01,
+	// for push services that predate RFC8292: `Authorization: WebPush <token>`,
+	// with the VAPID public key sent using the `Crypto-Key: p256ecdsa=<key>` header.
+	VAPIDSchemeWebPush VAPIDScheme = "WebPush"
+)
+
+// Checking allowable values for the VAPID scheme.
+func isValidVAPIDScheme(scheme VAPIDScheme) bool {
+	switch scheme {
+	case VAPIDSchemeVAPID, VAPIDSchemeWebPush:
+		return true
+	}
+	return false
+}
+
+// resolveVAPIDScheme returns the VAPID scheme to use for an audience.
+// The scheme of the endpoint host takes precedence over the pusher default.
+func (p *VAPIDPusher) resolveVAPIDScheme(aud string) VAPIDScheme {
+	if len(p.vapidHostSchemes) > 0 {
+		_, host, _ := strings.Cut(aud, "://")
+		if scheme, ok := p.vapidHostSchemes[strings.ToLower(host)]; ok {
+			return scheme
+		}
+	}
+	if p.vapidScheme != VAPIDSchemeUnset {
+		return p.vapidScheme
+	}
+	return VAPIDSchemeVAPID
+}
+
+// setVAPIDHeaders sets the Authorization header, and the Crypto-Key header of the legacy VAPID scheme.
+func (k reusableKey) setVAPIDHeaders(header http.Header) {
+	header["Authorization"] = []string{k.vapid}
+	if k.cryptoKey != "" {
+		header["Crypto-Key"] = []string{k.cryptoKey}
+	}
+}
+
+// setAuthorization sets the Authorization and Crypto-Key headers of a token signed by the key pair for the audience.
+// The scheme of an audience does not change, so the headers are cached with the token.
+func (p *VAPIDPusher) setAuthorization(auth *reusableKey, vapid *vapidIdentity, aud string, token string) {
+	if p.resolveVAPIDScheme(aud) == VAPIDSchemeWebPush {
+		auth.vapid, auth.cryptoKey = "WebPush "+token, "p256ecdsa="+vapid.publicKey
+		return
+	}
+	auth.vapid, auth.cryptoKey = vapid.authorization(token), ""
+}
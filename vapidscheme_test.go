@@ -0,0 +1,182 @@
+package fwebpush
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang-jwt/jwt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyWebPushToken checks that the legacy Authorization and Crypto-Key headers are signed by the pusher key pair.
+func verifyWebPushToken(t *testing.T, p *VAPIDPusher, header http.Header) {
+	t.Helper()
+	token, ok := strings.CutPrefix(header.Get("Authorization"), "WebPush ")
+	if !ok {
+		t.Fatalf("Incorrect Authorization scheme, got=%s", header.Get("Authorization"))
+	}
+	if key := headerParam(header.Get("Crypto-Key"), "p256ecdsa"); key != p.vapid.publicKey {
+		t.Fatalf("Incorrect Crypto-Key p256ecdsa, expected=%s, got=%s", p.vapid.publicKey, key)
+	}
+	_, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
+		return generateVAPIDHeaderKeys(p.vapid.privateKey).Public(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVAPIDScheme(t *testing.T) {
+	cases := []struct {
+		name     string
+		options  []VAPIDPusherOption
+		endpoint string
+		legacy   bool
+	}{
+		{"default", nil, "https://updates.push.services.mozilla.com/wpush/v2/gAAAAA", false},
+		{"pusher", []VAPIDPusherOption{WithVAPIDScheme(VAPIDSchemeWebPush)}, "https://updates.push.services.mozilla.com/wpush/v2/gAAAAA", true},
+		{"host", []VAPIDPusherOption{WithVAPIDSchemeForHosts(VAPIDSchemeWebPush, "Relay.example.com:8443")}, "https://relay.example.com:8443/push/1", true},
+		{"other host", []VAPIDPusherOption{WithVAPIDSchemeForHosts(VAPIDSchemeWebPush, "relay.example.com")}, "https://relay.example.com:8443/push/1", false},
+		{"host override", []VAPIDPusherOption{WithVAPIDScheme(VAPIDSchemeWebPush), WithVAPIDSchemeForHosts(VAPIDSchemeVAPID, "relay.example.com")}, "https://relay.example.com/push/1", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPusher(t, c.options...)
+			sub, privateKey, authSecret := newTestReceiver(t)
+			sub.Endpoint = c.endpoint
+
+			req, err := p.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.legacy {
+				verifyWebPushToken(t, p, req.Header)
+			} else {
+				verifyVAPIDToken(t, req.Header.Get("Authorization"), VAPIDIdentity{PublicKey: p.vapid.publicKey, PrivateKey: encodeBase64String(p.vapid.privateKey)})
+				if header := req.Header.Get("Crypto-Key"); header != "" {
+					t.Fatalf("Unexpected Crypto-Key, got=%s", header)
+				}
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := DecryptNotification(body, privateKey, authSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, message) {
+				t.Fatalf("Incorrect plaintext, expected=%q, got=%q", message, plaintext)
+			}
+		})
+	}
+}
+
+func TestVAPIDSchemeAESGCM(t *testing.T) {
+	p := newTestPusher(t, WithVAPIDScheme(VAPIDSchemeWebPush), WithContentEncoding(ContentEncodingAESGCM))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	req, err := p.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The p256ecdsa is merged into the Crypto-Key of the encoding.
+	if values := req.Header.Values("Crypto-Key"); len(values) != 1 || headerParam(values[0], "dh") == "" {
+		t.Fatalf("Incorrect Crypto-Key, got=%q", values)
+	}
+	verifyWebPushToken(t, p, req.Header)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptAESGCMNotification(body, req.Header, privateKey, authSecret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVAPIDSchemeTokenCache(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Hour, 0} {
+		p := newTestPusher(t, WithVAPIDScheme(VAPIDSchemeWebPush), WithVAPIDTokenTTL(ttl))
+		sub, _, _ := newTestReceiver(t)
+		keys, err := p.getCachedKeys(sub.Endpoint, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(keys.vapid, "WebPush ") || keys.cryptoKey != "p256ecdsa="+p.vapid.publicKey {
+			t.Fatalf("Incorrect headers, got=%s and %s", keys.vapid, keys.cryptoKey)
+		}
+	}
+
+	// The shared token is used with the scheme of each replica.
+	replicas := newTestReplicas(t, 2, NewKVTokenCache(newMemoryTokenKV(), ""), WithVAPIDSchemeForHosts(VAPIDSchemeWebPush, "updates.push.services.mozilla.com"))
+	replicas[1].vapidHostSchemes = nil
+	sub, _, _ := newTestReceiver(t)
+	now := time.Now()
+	legacy, err := replicas[0].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standard, err := replicas[1].getCachedKeys(sub.Endpoint, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := strings.TrimPrefix(legacy.vapid, "WebPush "); standard.vapid != replicas[1].vapid.authorization(token) {
+		t.Fatalf("Expected the shared token to be used, got=%s and %s", legacy.vapid, standard.vapid)
+	}
+
+	// The refresher keeps the scheme.
+	if err := replicas[0].refreshTokens(now.Add(56*time.Minute), TokenRefresherOptions{Lead: 5 * time.Minute, HotWindow: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := replicas[0].getCachedKeys(sub.Endpoint, now.Add(61*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.vapid == legacy.vapid || !strings.HasPrefix(renewed.vapid, "WebPush ") || renewed.cryptoKey != legacy.cryptoKey {
+		t.Fatalf("Incorrect renewed headers, got=%s and %s", renewed.vapid, renewed.cryptoKey)
+	}
+}
+
+func TestVAPIDSchemeInvalid(t *testing.T) {
+	privateKey, publicKey, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []VAPIDPusherOption{
+		WithVAPIDScheme("bearer"),
+		WithVAPIDSchemeForHosts("webpush", "relay.example.com"),
+	} {
+		if _, err := NewVAPIDPusher("test@test.com", publicKey, privateKey, option); err == nil {
+			t.Fatal("Expected an unsupported VAPID scheme error")
+		}
+	}
+}
+
+func TestVAPIDSchemeHeaders(t *testing.T) {
+	p := newTestPusher(t, WithVAPIDSchemeForHosts(VAPIDSchemeWebPush, "updates.push.services.mozilla.com"))
+	sub, privateKey, authSecret := newTestReceiver(t)
+	record, err := p.AppendEncrypted(nil, message, &sub, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := p.VAPIDHeaders(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyWebPushToken(t, p, header)
+	if _, err := DecryptNotification(record, privateKey, authSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other hosts use the default scheme, without Crypto-Key.
+	sub.Endpoint = "https://fcm.googleapis.com/fcm/send/abc"
+	header, err = p.VAPIDHeaders(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(header.Get("Authorization"), "vapid t=") || header.Get("Crypto-Key") != "" {
+		t.Fatalf("Incorrect headers, got=%v", header)
+	}
+}
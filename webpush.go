@@ -1,16 +1,14 @@
 package fwebpush
 
 import (
-	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/mawngo/go-fwebpush/ece"
 	"golang.org/x/crypto/hkdf"
 	"io"
 	"net/http"
@@ -26,23 +24,26 @@
 
 var ErrMaxSizeExceeded = errors.New("message too large")
 var ErrEncryption = errors.New("encryption error")
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+var ErrPusherClosed = errors.New("pusher closed")
 
 var (
-	nonceInfo                = []byte("Content-Encoding: nonce\x00")
-	contentEncryptionKeyInfo = []byte("Content-Encoding: aes128gcm\x00")
-	webpushInfo              = []byte("WebPush: info\x00")
+	nonceInfo   = []byte("Content-Encoding: nonce\x00")
+	webpushInfo = []byte("WebPush: info\x00")
 )
 
 // Pre-allocated byte buffer format
 // Key buffer:
 //   - [hkdf] authSecret (16)
 //   - [hkdf] sharedECDHSecret (32)
-//   - [hkdf] prkHKDF (60)
+//   - [hkdf] ikm (32)
+//   - [hkdf] salt (16)
+//   - [hkdf] unused (12)
 //   - [prk] webpushInfo (14)
 //   - [prk] dh (65)
 //   - [prk] localPublicKey (65)
 //
-// Record buffer:
+// Record buffer (see package ece):
 //   - [record] salt (16)
 //   - [record] rs (4)
 //   - [record] localPublicKeyLen (1)
@@ -51,6 +52,8 @@
 //   - [record] padding delimiter (1)
 //   - [record] padding
 //   - [record] gcmTag (16)
+//
+// When rs is configured, the data is split into multiple records.
 const (
 	authSecretLen       = 16
 	sharedECDHSecretLen = 32
@@ -81,21 +84,50 @@
 )
 
 type VAPIDPusher struct {
-	client                   *http.Client
-	subject                  string        // Sub in VAPID JWT token.
-	vapidPublicKeyHeaderPart string        // VAPID public key passed in the VAPID Authorization header (format: `, k=<key`).
-	vapidPrivateKey          []byte        // VAPID private key, used to sign VAPID JWT token.
-	vapidTokenTTL            time.Duration // Optional, expiration for VAPID JWT token.
-	vapidTTLBuffer           time.Duration
-	localSecretTTLFn         func() time.Duration // Optional, enable reuse of the local public key and secret.
-	randReader               io.Reader
-	recordSize               int
-	maxRecordSize            int
-
-	mu    sync.RWMutex
-	cache map[string]reusableKey // Cache of VAPID JWT token by audience.
+	client               *http.Client
+	subject              string                    // Sub in VAPID JWT token.
+	vapid                vapidIdentity             // VAPID key pair, used by subscriptions without key ID.
+	vapidIdentities      map[string]*vapidIdentity // Optional, additional VAPID key pairs by key ID.
+	vapidIdentityConfigs []VAPIDIdentity           // Additional VAPID key pairs to decode, see [WithVAPIDIdentities].
+	vapidTokenTTL        time.Duration             // Optional, expiration for VAPID JWT token.
+	vapidTTLBuffer       time.Duration
+	localSecretTTLFn     func() time.Duration // Optional, enable reuse of the local public key and secret.
+	localKeyStore        LocalKeyStore        // Optional, store of the local keys instead of the Subscription.
+	localKeyRing         *LocalKeyRing        // Optional, seal the ikm of the local keys.
+	randReader           io.Reader            // Source of all randomness: salt, local key pair and VAPID token signature.
+	localPrivateKey      *ecdh.PrivateKey     // Optional, fixed local key pair.
+	localKeyRotation     time.Duration        // Optional, 0 rotates the local key pair with the VAPID token, negative per message.
+	localKeyPool         *LocalKeyPool        // Optional, pre-generated local key pairs.
+	payloadSigner        *PayloadSigner       // Optional, sign the payload before encryption.
+	compressPayload      bool                 // Optional, prepend the compression header, compressing if required.
+	padding              Padding              // Optional, padding policy.
+	maxRecordSize        int
+	rs                   int                    // Optional, RFC8188 record size, 0 means single record.
+	contentEncoding      ContentEncoding        // Optional, default content encoding.
+	vapidScheme          VAPIDScheme            // Optional, default VAPID Authorization scheme.
+	vapidHostSchemes     map[string]VAPIDScheme // Optional, VAPID Authorization scheme by endpoint host.
+	zeroize              bool                   // Optional, clear the key material after use.
+	tokenCacheSize       int                    // Max number of cached VAPID JWT tokens.
+	tokenCacheSweep      time.Duration          // Interval of sweeping the expired VAPID JWT tokens.
+	tokenCache           TokenCache             // Optional, VAPID JWT tokens shared across processes.
+
+	mu     sync.RWMutex
+	cache  *tokenCache // Cache of VAPID JWT token by key ID and audience.
+	closed bool
+}
+
+// vapidCacheKey is the key of the VAPID token cache.
+type vapidCacheKey struct {
+	keyID string
+	aud   string
 }
 
+// NewVAPIDPusher creates a pusher signing the VAPID tokens with the base64 encoded key pair.
+//
+// The key pair is validated: a private key longer than 32 bytes, or out of the P-256 scalar range, fails with
+// [ErrInvalidVAPIDKey], and a public key that does not match the private key fails with [ErrVAPIDKeyMismatch].
+// Shorter private keys, whose leading zero bytes were stripped, are left-padded and still accepted.
+// Previous versions accepted these key pairs, sending VAPID tokens rejected by the push services when mismatched.
 func NewVAPIDPusher(
 	subject string,
 	vapidPublicKey string,
@@ -103,37 +135,52 @@ func NewVAPIDPusher(
 	options ...VAPIDPusherOption,
 ) (*VAPIDPusher, error) {
 	c := &VAPIDPusher{
-		vapidTokenTTL:  1 * time.Hour,
-		cache:          make(map[string]reusableKey),
-		vapidTTLBuffer: 10 * time.Minute,
-		randReader:     rand.Reader,
-		maxRecordSize:  MaxRecordSize,
+		vapidTokenTTL:   1 * time.Hour,
+		vapidTTLBuffer:  10 * time.Minute,
+		randReader:      rand.Reader,
+		maxRecordSize:   MaxRecordSize,
+		tokenCacheSize:  defaultTokenCacheSize,
+		tokenCacheSweep: defaultTokenCacheSweepInterval,
 	}
 	for _, opt := range options {
 		opt(c)
 	}
+	c.cache = newTokenCache(c.tokenCacheSize, c.tokenCacheSweep)
 
 	if c.vapidTokenTTL+c.vapidTTLBuffer > 24*time.Hour {
 		return nil, errors.New("total VAPID token must be less than 24 hours")
 	}
 
+	if c.vapidScheme != VAPIDSchemeUnset && !isValidVAPIDScheme(c.vapidScheme) {
+		return nil, fmt.Errorf("unsupported VAPID scheme: %s", c.vapidScheme)
+	}
+	for host, scheme := range c.vapidHostSchemes {
+		if !isValidVAPIDScheme(scheme) {
+			return nil, fmt.Errorf("unsupported VAPID scheme of %s: %s", host, scheme)
+		}
+	}
+
 	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https:") {
 		subject = "mailto:" + subject
 	}
 	c.subject = subject
 
-	// Decode the VAPID private key.
-	var err error
-	c.vapidPrivateKey, err = decodeBase64(vapidPrivateKey)
+	// Decode the VAPID keys.
+	vapid, err := newVAPIDIdentity(VAPIDIdentity{PublicKey: vapidPublicKey, PrivateKey: vapidPrivateKey})
 	if err != nil {
 		return nil, err
 	}
-	// Decode the VAPID public key.
-	vapidPublicKeyBytes, err := decodeBase64(vapidPublicKey)
-	if err != nil {
+	c.vapid = *vapid
+	if err := c.parseVAPIDIdentities(c.vapidIdentityConfigs); err != nil {
 		return nil, err
 	}
-	c.vapidPublicKeyHeaderPart = ", k=" + encodeBase64String(vapidPublicKeyBytes)
+	c.vapidIdentityConfigs = nil
+	if c.payloadSigner != nil {
+		c.payloadSigner, err = c.payloadSigner.withRand(c.signingRand())
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if c.client == nil {
 		c.client = &http.Client{
@@ -143,12 +190,38 @@ func NewVAPIDPusher(
 	return c, nil
 }
 
+// Close wipes the VAPID private keys, and drops the cached VAPID tokens and local key pairs.
+// The pusher cannot be used after closing, the encryption fails with [ErrPusherClosed].
+//
+// The local key pairs cannot be wiped, as the standard library does not expose their memory.
+// The configured [LocalKeyPool] is not closed.
+func (p *VAPIDPusher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	clear(p.vapid.privateKey)
+	p.vapid.privateKey = nil
+	for _, k := range p.vapidIdentities {
+		clear(k.privateKey)
+		k.privateKey = nil
+	}
+	p.cache.clear()
+	return nil
+}
+
 // Options are config and extra params needed to send a notification.
 type Options struct {
 	Topic      string  // Set the Topic header to collapse a pending message.
 	TTL        int     // Set the TTL on the endpoint POST request.
 	Urgency    Urgency // Set the Urgency header.
-	RecordSize int     // Set the target record size for padding.
+	RecordSize int     // Set the target record size for padding, overriding the Padding.
+	Padding    Padding // Set the padding policy, overriding the pusher setting.
+	RS         int     // Set the RFC8188 record size, splitting the message into multiple records.
+	// Set the content encoding, overriding the Subscription and pusher setting.
+	ContentEncoding ContentEncoding
 }
 
 // Keys are the base64 encoded values from PushSubscription.getKey().
@@ -162,19 +235,34 @@ type Subscription struct {
 	Endpoint string    `json:"endpoint"`
 	Keys     Keys      `json:"keys"`
 	LocalKey *LocalKey `json:"lk"`
+	// ContentEncoding is the content encoding supported by the user agent, from PushManager.supportedContentEncodings.
+	// Optional, the pusher setting is used if empty.
+	ContentEncoding ContentEncoding `json:"contentEncoding,omitempty"`
+	// VAPIDKeyID is the ID of the VAPID key pair the subscription was created with, see [VAPIDPusher.ApplicationServerKey].
+	// Optional, the pusher key pair is used if empty.
+	VAPIDKeyID string `json:"vapidKeyId,omitempty"`
 }
 
 type LocalKey struct {
+	// Version of the format, see [LocalKey.FormatVersion].
+	Version int `json:"v,omitempty"`
 	// Public generated public key.
 	Public string `json:"p"`
 	// Secret generated secret.
 	//
-	// Deprecated: switched to IKM caching.
+	// Deprecated: switched to IKM caching, use [MigrateLocalKey] to upgrade.
 	Secret string `json:"s,omitempty"`
 	// IKM generated ikm.
 	IKM string `json:"m,omitempty"`
+	// KeyID is the ID of the key-encryption key sealing the ikm, see [LocalKeyRing].
+	KeyID string `json:"k,omitempty"`
+	// SealedIKM generated ikm sealed by the key-encryption key, replacing IKM.
+	SealedIKM string `json:"sm,omitempty"`
 	// At creation timestamp, used for checking expiration.
 	At int64 `json:"a"`
+	// Fingerprint of the subscription keys the ikm was derived from, set by the [LocalKeyStore] caching,
+	// so the key is not reused once the subscription is re-keyed.
+	Fingerprint string `json:"f,omitempty"`
 }
 
 // IsVapidTokenCachingEnabled returns whether the VAPID token caching feature is enabled.
@@ -197,8 +285,14 @@ func (p *VAPIDPusher) SendNotification(ctx context.Context, message []byte, sub
 // SendNotificationOptions sends a push notification to a subscription's endpoint.
 // Message Encryption for Web Push, and VAPID protocols.
 // FOR MORE INFORMATION SEE RFC8291: https://datatracker.ietf.org/doc/rfc8291.
+//
+// The LocalKey of the subscription is updated when the local secret caching generates a new one,
+// unless a [LocalKeyStore] is configured, see [WithLocalSecretTTL] for concurrent use.
 func (p *VAPIDPusher) SendNotificationOptions(ctx context.Context, message []byte, sub *Subscription, options Options) (*http.Response, error) {
-	req, err := p.PrepareNotificationRequest(ctx, message, sub, options)
+	// The record buffer is pooled, it is released once the request is done and the body is closed.
+	buf := getRecordBuffer()
+	defer buf.release()
+	req, err := p.prepareNotificationRequest(ctx, message, sub, options, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -212,158 +306,271 @@ func (p *VAPIDPusher) SendNotificationOptions(ctx context.Context, message []byt
 //
 // It is recommended to use [VAPIDPusher.SendNotification] directly instead.
 func (p *VAPIDPusher) PrepareNotificationRequest(ctx context.Context, message []byte, sub *Subscription, options Options) (*http.Request, error) {
+	return p.prepareNotificationRequest(ctx, message, sub, options, nil)
+}
+
+// AppendEncrypted encrypts the message for a subscription using the aes128gcm content encoding,
+// and appends the encrypted body to dst, returning the extended buffer.
+// The dst is grown at most once, so reusing a dst with enough capacity avoids allocating the record.
+//
+// The request headers must be set by the caller, the VAPID headers signed by the key pair of the subscription
+// can be obtained using [VAPIDPusher.VAPIDHeaders].
+// The legacy aesgcm encoding is not supported, as its body requires extra headers.
+// The LocalKey of the subscription is updated when the local secret caching generates a new one,
+// unless a [LocalKeyStore] is configured.
+func (p *VAPIDPusher) AppendEncrypted(dst []byte, message []byte, sub *Subscription, options Options) ([]byte, error) {
 	now := time.Now()
-	// GENERATE VAPID TOKEN AND LOCAL KEYPAIR.
-	keys, err := p.getCachedKeys(sub.Endpoint, now)
+	parsed, err := p.parseSubscription(sub, options, now)
+	if err != nil {
+		return dst, err
+	}
+	dst, localKey, err := p.appendEncryptedParsed(dst, message, &parsed, options, now)
+	if localKey != nil && p.localKeyStore == nil {
+		sub.LocalKey = localKey
+	}
+	return dst, err
+}
+
+// prepareNotificationRequest prepare a push notification request,
+// writing the record into the pooled buffer if not nil.
+func (p *VAPIDPusher) prepareNotificationRequest(ctx context.Context, message []byte, sub *Subscription, options Options, buf *recordBuffer) (*http.Request, error) {
+	var dst []byte
+	if buf != nil {
+		dst = buf.b[:0]
+	}
+	msg, err := p.encryptSubscription(dst, message, sub, options)
 	if err != nil {
 		return nil, err
 	}
+	if msg.LocalKey != nil && p.localKeyStore == nil {
+		sub.LocalKey = msg.LocalKey
+	}
+	if buf != nil {
+		buf.b = msg.Body
+	}
+	return msg.newRequest(ctx, buf)
+}
+
+// encryptSubscription encrypts the message for a subscription, the body is appended to dst.
+// The subscription is not modified.
+func (p *VAPIDPusher) encryptSubscription(dst []byte, message []byte, sub *Subscription, options Options) (EncryptedMessage, error) {
+	now := time.Now()
+	parsed, err := p.parseSubscription(sub, options, now)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	return p.encryptNotification(dst, message, &parsed, options, now)
+}
+
+// encryptNotification encrypts the message and prepare the headers, the body is appended to dst.
+// The message holds the local key if a new one is generated by the local secret caching.
+func (p *VAPIDPusher) encryptNotification(dst []byte, message []byte, sub *ParsedSubscription, options Options, now time.Time) (EncryptedMessage, error) {
+	encoding := p.resolveContentEncoding(sub.contentEncoding, options)
+	if !isValidContentEncoding(encoding) {
+		return EncryptedMessage{}, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	// GENERATE VAPID TOKEN AND LOCAL KEYPAIR.
+	vapid, err := p.resolveVAPIDIdentity(sub.vapidKeyID, now)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	keys, err := p.getCachedKeysAud(vapid, sub.audience, now)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	message, err = p.encodePayload(message, encoding, options, now)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+
+	msg := EncryptedMessage{
+		Endpoint: sub.endpoint,
+		Header:   newPushHeader(options, keys),
+		Expiry:   keys.exp,
+	}
+	if encoding == ContentEncodingAESGCM {
+		var encryption string
+		msg.Body, encryption, err = p.encryptAESGCM(dst, message, sub, keys, options)
+		if err != nil {
+			return EncryptedMessage{}, err
+		}
+		msg.Header["Content-Encoding"] = []string{string(ContentEncodingAESGCM)}
+		msg.Header["Encryption"] = []string{encryption}
+		// Merged with the Crypto-Key of the legacy VAPID scheme, which only holds the p256ecdsa.
+		msg.Header["Crypto-Key"] = []string{"dh=" + encodeBase64String(keys.localPublicKeyBytes) + ";p256ecdsa=" + vapid.publicKey}
+		return msg, nil
+	}
+
+	msg.Body, msg.LocalKey, err = p.appendEncrypted(dst, message, sub, options, keys, now)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	msg.Header["Content-Encoding"] = []string{string(ContentEncodingAES128GCM)}
+	return msg, nil
+}
+
+// appendEncryptedParsed encrypts the message using the aes128gcm content encoding, and appends the record to dst.
+func (p *VAPIDPusher) appendEncryptedParsed(dst []byte, message []byte, sub *ParsedSubscription, options Options, now time.Time) ([]byte, *LocalKey, error) {
+	if encoding := p.resolveContentEncoding(sub.contentEncoding, options); encoding != ContentEncodingAES128GCM {
+		return dst, nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	vapid, err := p.resolveVAPIDIdentity(sub.vapidKeyID, now)
+	if err != nil {
+		return dst, nil, err
+	}
+	keys, err := p.getCachedKeysAud(vapid, sub.audience, now)
+	if err != nil {
+		return dst, nil, err
+	}
+	message, err = p.encodePayload(message, ContentEncodingAES128GCM, options, now)
+	if err != nil {
+		return dst, nil, err
+	}
+	return p.appendEncrypted(dst, message, sub, options, keys, now)
+}
 
-	// Pre-alloc for record.
-	dataLen := len(message) + 1
-	cipherTextLen := dataLen + gcmTagLen
-	recordLen := headerLen + cipherTextLen
+// appendEncrypted encrypts the message using the aes128gcm content encoding, and appends the record to dst.
+// The local key is returned if a new one is generated by the local secret caching.
+func (p *VAPIDPusher) appendEncrypted(dst []byte, message []byte, sub *ParsedSubscription, options Options, keys reusableKey, now time.Time) ([]byte, *LocalKey, error) {
+	// Calculate record size.
+	rs := p.resolveRS(options)
+	recordLen := headerLen + ece.RecordsLen(len(message), rs)
 	if p.maxRecordSize > 0 && recordLen > p.maxRecordSize {
-		return nil, fmt.Errorf("size %d exceeds %d %w", recordLen, p.maxRecordSize, ErrMaxSizeExceeded)
+		return dst, nil, fmt.Errorf("size %d exceeds %d %w", recordLen, p.maxRecordSize, ErrMaxSizeExceeded)
 	}
 
 	// Calculate padded size.
-	recordSize := p.recordSize
-	if options.RecordSize > 0 {
-		recordSize = options.RecordSize
+	recordSize, err := p.paddedSize(recordLen, options)
+	if err != nil {
+		return dst, nil, err
 	}
+	padLen := 0
 	if recordLen < recordSize {
-		padLen := recordSize - recordLen
-		recordLen = recordSize
-		cipherTextLen += padLen
-		dataLen += padLen
+		padLen = ece.ContentLen(recordSize-headerLen, rs) - len(message)
 	}
-	record := make([]byte, recordLen)
 
-	// Pre-alloc for keys.
-	// This buffer can be pooled, reduce allocations.
-	// Not sure about the performance impact through.
-	keyBuf := make([]byte, prkPublicKeyOffset+localPublicKeyLen)
+	// Pooled buffer for keys, every part is written before being read.
+	pooledKeyBuf := getKeyBuf()
+	defer p.releaseKeyBuf(pooledKeyBuf)
+	keyBuf := pooledKeyBuf[:]
 	hash := sha256.New
 
 	// GENERATE IKM AND PUBLIC KEY.
-	localPublicKeyBytes := record[localPublicKeyOffset : localPublicKeyOffset+localPublicKeyLen : localPublicKeyOffset+localPublicKeyLen]
+	var localKey *LocalKey
+	localPublicKeyBytes := keyBuf[prkPublicKeyOffset : prkPublicKeyOffset+localPublicKeyLen : prkPublicKeyOffset+localPublicKeyLen]
 	ikm := keyBuf[hkdfOffset : hkdfOffset+32 : hkdfOffset+32]
-	if p.localSecretTTLFn != nil && sub.LocalKey != nil && sub.LocalKey.At > now.Add(-p.localSecretTTLFn()).UnixMilli() && sub.LocalKey.IKM != "" {
-		// Use publicKey and ikm from LocalKey.
-		if err = decodeBase64Buff(sub.LocalKey.Public, localPublicKeyBytes); err != nil {
-			return nil, errors.Join(ErrEncryption, err)
+	cached := sub.localKey
+	if !cached.set && !sub.localKeyLoaded && p.localKeyStore != nil && p.localSecretTTLFn != nil {
+		cached, err = p.loadLocalKey(sub.endpoint, sub.keysFingerprint())
+		if err != nil {
+			return dst, nil, err
 		}
-		if err = decodeBase64Buff(sub.LocalKey.IKM, ikm); err != nil {
-			return nil, errors.Join(ErrEncryption, err)
+	}
+	if cached.set && p.isLocalKeyFresh(cached.at, now) {
+		// Use publicKey and ikm from LocalKey.
+		if err := p.openLocalKey(&cached); err != nil {
+			return dst, nil, errors.Join(ErrEncryption, err)
 		}
+		copy(localPublicKeyBytes, cached.public[:])
+		copy(ikm, cached.ikm[:])
 	} else {
+		if sub.publicKey == nil {
+			return dst, nil, fmt.Errorf("missing subscription keys %w", ErrEncryption)
+		}
 		// We need to copy instead of re-assign, as the localPublicKeyBytes is actually a required part
-		// of the record.
+		// of the prk info.
 		copy(localPublicKeyBytes, keys.localPublicKeyBytes)
 		// Derive ECDH shared secret.
-		// Decode auth and P256dh into a pre allocated buffer.
+		// Copy auth and P256dh into a pre allocated buffer.
 		authSecret := keyBuf[:authSecretLen:authSecretLen]
-		dh := keyBuf[dhOffset : dhOffset+p256dhLen : dhOffset+p256dhLen]
-		if err := decodeBase64Buff(sub.Keys.Auth, authSecret); err != nil {
-			return nil, errors.Join(ErrEncryption, err)
-		}
-		if err := decodeBase64Buff(sub.Keys.P256dh, dh); err != nil {
-			return nil, errors.Join(ErrEncryption, err)
-		}
-		dhPublicKey, err := keys.curve.NewPublicKey(dh)
-		if err != nil {
-			return nil, errors.Join(ErrEncryption, err)
-		}
-		sharedECDHSecret, err := keys.localPrivateKey.ECDH(dhPublicKey)
+		copy(authSecret, sub.auth[:])
+		copy(keyBuf[dhOffset:dhOffset+p256dhLen:dhOffset+p256dhLen], sub.p256dh[:])
+		sharedECDHSecret, err := keys.localPrivateKey.ECDH(sub.publicKey)
 		if err != nil {
-			return nil, errors.Join(ErrEncryption, err)
+			return dst, nil, errors.Join(ErrEncryption, err)
 		}
 
 		// ikm.
 		copy(keyBuf[prkOffset:prkOffset+webPushInfoLen:prkOffset+webPushInfoLen], webpushInfo)
-		copy(keyBuf[prkPublicKeyOffset:prkPublicKeyOffset+localPublicKeyLen:prkPublicKeyOffset+localPublicKeyLen], localPublicKeyBytes)
 		prkInfo := keyBuf[prkOffset:]
 		prkHKDF := hkdf.New(hash, sharedECDHSecret, authSecret, prkInfo)
 		ikm, err = getHKDFKey(prkHKDF, ikm)
+		p.wipe(sharedECDHSecret)
 		if err != nil {
-			return nil, errors.Join(ErrEncryption, err)
+			return dst, nil, errors.Join(ErrEncryption, err)
 		}
 
-		// Update LocalKey if enabled.
+		// Return the new LocalKey if enabled, and save it to the store.
 		if p.localSecretTTLFn != nil {
-			sub.LocalKey = &LocalKey{
-				Public: encodeBase64String(localPublicKeyBytes),
-				IKM:    encodeBase64String(ikm),
-				At:     now.UnixMilli(),
+			if p.localKeyRing != nil {
+				localKey, err = p.localKeyRing.seal(localPublicKeyBytes, ikm, now.UnixMilli(), p.randReader)
+				if err != nil {
+					return dst, nil, errors.Join(ErrEncryption, err)
+				}
+			} else {
+				localKey = &LocalKey{
+					Version: LocalKeyVersion,
+					Public:  encodeBase64String(localPublicKeyBytes),
+					IKM:     encodeBase64String(ikm),
+					At:      now.UnixMilli(),
+				}
+			}
+			if p.localKeyStore != nil {
+				localKey.Fingerprint = sub.keysFingerprint()
+				if err := p.localKeyStore.Store(sub.endpoint, localKey); err != nil {
+					return dst, nil, fmt.Errorf("error storing local key: %w", err)
+				}
 			}
 		}
 	}
 
 	// GENERATE PAYLOAD.
-	bufHKDF := keyBuf[hkdfOffset:prkOffset:prkOffset]
-	salt := record[:saltLen:saltLen]
-	rs := record[rsOffset : rsOffset+rsLen : rsOffset+rsLen]
-	// Use data slice for both data and cipher text.
-	data := record[dataOffset : dataOffset+dataLen : dataOffset+cipherTextLen]
-
+	salt := keyBuf[hkdfOffset+32 : hkdfOffset+48 : hkdfOffset+48]
 	err = p.genSalt(salt)
 	if err != nil {
-		return nil, errors.Join(ErrEncryption, err)
-	}
-	// Derive Content Encryption Key.
-	contentHKDF := hkdf.New(hash, ikm, salt, contentEncryptionKeyInfo)
-	contentEncryptionKey, err := getHKDFKey(contentHKDF, bufHKDF[32:48:48])
-	if err != nil {
-		return nil, errors.Join(ErrEncryption, err)
-	}
-	// Derive the Nonce.
-	nonceHKDF := hkdf.New(hash, ikm, salt, nonceInfo)
-	nonce, err := getHKDFKey(nonceHKDF, bufHKDF[48:60:60])
+		return dst, nil, errors.Join(ErrEncryption, err)
+	}
+	dst, err = ece.AppendEncrypt(dst, ikm, message, ece.Params{
+		Salt:  salt,
+		KeyID: localPublicKeyBytes,
+		RS:    rs,
+		Pad:   padLen,
+	})
 	if err != nil {
-		return nil, errors.Join(ErrEncryption, err)
+		return dst, nil, errors.Join(ErrEncryption, err)
 	}
-	// Cipher.
-	c, err := aes.NewCipher(contentEncryptionKey)
-	if err != nil {
-		return nil, errors.Join(ErrEncryption, err)
+	return dst, localKey, nil
+}
+
+// resolveRS returns the RFC8188 record size of the aes128gcm encoding, 0 means single record.
+func (p *VAPIDPusher) resolveRS(options Options) int {
+	if options.RS > 0 {
+		return max(options.RS, ece.MinRS)
 	}
-	gcm, err := cipher.NewGCMWithTagSize(c, gcmTagLen)
-	if err != nil {
-		return nil, errors.Join(ErrEncryption, err)
-	}
-
-	// Data.
-	copy(data, message)
-	// End padding.
-	data[len(message)] = 2
-	// Compose the ciphertext.
-	ciphertext := gcm.Seal(data[:0], nonce, data, nil)
-	// From the spec, rs must greater than: plaintext data + padding delimiter + padding + gcmTag,
-	// which equal to computed cipherTextLen.
-	// Most of the lib I found just use 4096 here, as it is the payload limit.
-	binary.BigEndian.PutUint32(rs, uint32(max((cipherTextLen+1)*8, MaxRecordSize)))
-
-	// Encryption Content-Coding Header.
-	record[keyOffset] = byte(len(localPublicKeyBytes))
-	copy(record[dataOffset:], ciphertext)
-
-	// PREPARE REQUEST.
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(record))
-	if err != nil {
-		return nil, err
+	return p.rs
+}
+
+// recordLen returns the unpadded size of the encrypted body of a message.
+func (p *VAPIDPusher) recordLen(encoding ContentEncoding, messageLen int, options Options) int {
+	if encoding == ContentEncodingAESGCM {
+		return aesgcmPadLenLen + messageLen + gcmTagLen
 	}
-	req.Header["Content-Encoding"] = []string{"aes128gcm"}
-	req.Header["Content-Type"] = []string{"application/octet-stream"}
-	req.Header["TTL"] = []string{strconv.Itoa(options.TTL)}
+	return headerLen + ece.RecordsLen(messageLen, p.resolveRS(options))
+}
+
+// newPushHeader create the push request headers shared by all content encodings.
+func newPushHeader(options Options, keys reusableKey) http.Header {
+	header := make(http.Header, 6)
+	header["Content-Type"] = []string{"application/octet-stream"}
+	header["TTL"] = []string{strconv.Itoa(options.TTL)}
 	if options.Urgency != UrgencyUnset && isValidUrgency(options.Urgency) {
-		req.Header["Urgency"] = []string{string(options.Urgency)}
+		header["Urgency"] = []string{string(options.Urgency)}
 	}
 	if options.Topic != "" {
-		req.Header["Topic"] = []string{options.Topic}
+		header["Topic"] = []string{options.Topic}
 	}
-	req.Header["Authorization"] = []string{keys.vapid}
-	return req, nil
+	keys.setVAPIDHeaders(header)
+	return header
 }
 
 // ExecuteRequest send an [http.Request] using the underlying client,
@@ -375,8 +582,8 @@ func (p *VAPIDPusher) ExecuteRequest(req *http.Request) (*http.Response, error)
 	return p.client.Do(req)
 }
 
-// GenVAPIDAuthHeader generate the web push vapid auth header.
-// Should only be used for debug/logging.
+// GenVAPIDAuthHeader generate the web push vapid auth header, signed by the pusher key pair.
+// Should only be used for debug/logging, see [VAPIDPusher.VAPIDHeaders] to send the encrypted messages.
 func (p *VAPIDPusher) GenVAPIDAuthHeader(subscriptionEndpoint string) (string, error) {
 	keys, err := p.getCachedKeys(subscriptionEndpoint, time.Now())
 	if err != nil {
@@ -385,6 +592,34 @@ func (p *VAPIDPusher) GenVAPIDAuthHeader(subscriptionEndpoint string) (string, e
 	return keys.vapid, nil
 }
 
+// VAPIDHeaders returns the VAPID headers of a subscription: the Authorization header,
+// signed by the key pair of the subscription VAPIDKeyID (see [WithVAPIDIdentities]),
+// and the Crypto-Key header with the legacy [VAPIDSchemeWebPush].
+// The token is cached as for the pushed messages.
+// Useful with [VAPIDPusher.AppendEncrypted], which does not set the request headers.
+func (p *VAPIDPusher) VAPIDHeaders(sub *Subscription) (http.Header, error) {
+	ps := ParsedSubscription{endpoint: sub.Endpoint, vapidKeyID: sub.VAPIDKeyID}
+	if err := ps.parseAudience(); err != nil {
+		return nil, err
+	}
+	return p.vapidHeaders(&ps, time.Now())
+}
+
+// vapidHeaders returns the VAPID headers of a subscription.
+func (p *VAPIDPusher) vapidHeaders(sub *ParsedSubscription, now time.Time) (http.Header, error) {
+	vapid, err := p.resolveVAPIDIdentity(sub.vapidKeyID, now)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.getCachedKeysAud(vapid, sub.audience, now)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header, 2)
+	keys.setVAPIDHeaders(header)
+	return header, nil
+}
+
 // genSalt generates a salt of 16 bytes.
 func (p *VAPIDPusher) genSalt(salt []byte) error {
 	_, err := io.ReadFull(p.randReader, salt)
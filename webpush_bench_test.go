@@ -5,6 +5,7 @@
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
@@ -19,6 +20,7 @@
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -161,6 +163,65 @@ func BenchmarkNoCaching(b *testing.B) {
 	}, WithVAPIDTokenTTL(0))
 }
 
+func BenchmarkPerMessageLocalKey(b *testing.B) {
+	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
+		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
+			for b.Loop() {
+				sub := sub
+				_, err := pusher.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+				if err != nil {
+					b.Fatal(err)
+					return
+				}
+			}
+		})
+	}, WithPerMessageLocalKey())
+}
+
+// BenchmarkPerMessageLocalKeyPool is BenchmarkPerMessageLocalKey with a pool pre-filled for the whole run,
+// so the difference is the key generation taken off the sending path.
+func BenchmarkPerMessageLocalKeyPool(b *testing.B) {
+	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
+		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
+			pool := newFilledLocalKeyPool(b, b.N)
+			defer pool.Close()
+			pusher.localKeyPool = pool
+			b.ResetTimer()
+			for range b.N {
+				sub := sub
+				_, err := pusher.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
+				if err != nil {
+					b.Fatal(err)
+					return
+				}
+			}
+			b.StopTimer()
+			if misses := pool.Misses(); misses > 0 {
+				b.Fatalf("Expected the pool to never be empty, got %d misses", misses)
+			}
+		})
+	}, WithPerMessageLocalKey())
+}
+
+// newFilledLocalKeyPool creates a pool holding n pre-generated key pairs, without the background refill
+// competing with the benchmark.
+func newFilledLocalKeyPool(b *testing.B, n int) *LocalKeyPool {
+	pool := &LocalKeyPool{
+		keys: make(chan *ecdh.PrivateKey, n),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	close(pool.done)
+	for range n {
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.keys <- key
+	}
+	return pool
+}
+
 func BenchmarkVapidAndLocalSecretCachingExpired(b *testing.B) {
 	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
 		_, err := pusher.PrepareNotificationRequest(context.Background(), message, &sub, Options{})
@@ -248,6 +309,50 @@ func BenchmarkVapidAndLocalSecretCaching(b *testing.B) {
 	}, WithVAPIDTokenTTL(time.Hour), WithLocalSecretTTL(time.Hour))
 }
 
+func BenchmarkAppendEncrypted(b *testing.B) {
+	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
+		dst, err := pusher.AppendEncrypted(nil, message, &sub, Options{})
+		if err != nil {
+			b.Fatal(err)
+			return
+		}
+		if sub.LocalKey == nil {
+			b.Fatal("local key not generated")
+		}
+
+		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
+			for b.Loop() {
+				dst, err = pusher.AppendEncrypted(dst[:0], message, &sub, Options{})
+				if err != nil {
+					b.Fatal(err)
+					return
+				}
+			}
+		})
+	}, WithVAPIDTokenTTL(time.Hour), WithLocalSecretTTL(time.Hour))
+}
+
+func BenchmarkParsedSubscription(b *testing.B) {
+	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
+		parsed, err := ParseSubscription(sub)
+		if err != nil {
+			b.Fatal(err)
+			return
+		}
+
+		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
+			var dst []byte
+			for b.Loop() {
+				dst, _, err = pusher.AppendEncryptedParsed(dst[:0], message, parsed, Options{})
+				if err != nil {
+					b.Fatal(err)
+					return
+				}
+			}
+		})
+	})
+}
+
 func BenchmarkVapidAndLocalSecretCachingCacheInit(b *testing.B) {
 	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
 		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
@@ -278,6 +383,84 @@ func BenchmarkGetCachedKey(b *testing.B) {
 	}, WithVAPIDTokenTTL(0))
 }
 
+func BenchmarkGetCachedKeyHit(b *testing.B) {
+	benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int) {
+		b.Run(fmt.Sprintf("run_%d", i), func(b *testing.B) {
+			for b.Loop() {
+				_, err := pusher.getCachedKeys(sub.Endpoint, time.Now())
+				if err != nil {
+					b.Fatal(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkGetCachedKeyManyAudiences(b *testing.B) {
+	endpoints := make([]string, 1000)
+	for i := range endpoints {
+		endpoints[i] = fmt.Sprintf("https://push%d.example.com/sub", i)
+	}
+	// The smallest cache evicts on every call, signing a new token.
+	for _, size := range []int{100, len(endpoints)} {
+		b.Run(fmt.Sprintf("size_%d", size), func(b *testing.B) {
+			benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, _ Subscription, i int) {
+				if i > 0 {
+					return
+				}
+				for _, endpoint := range endpoints {
+					if _, err := pusher.getCachedKeys(endpoint, time.Now()); err != nil {
+						b.Fatal(err)
+					}
+				}
+				n := 0
+				for b.Loop() {
+					_, err := pusher.getCachedKeys(endpoints[n%len(endpoints)], time.Now())
+					if err != nil {
+						b.Fatal(err)
+						return
+					}
+					n++
+				}
+			}, WithVAPIDTokenCacheSize(size))
+		})
+	}
+}
+
+func BenchmarkGetCachedKeyParallel(b *testing.B) {
+	endpoints := make([]string, 64)
+	for i := range endpoints {
+		endpoints[i] = fmt.Sprintf("https://push%d.example.com/sub", i)
+	}
+	// A single hot audience, or many audiences spread over the cache.
+	for _, n := range []int{1, len(endpoints)} {
+		b.Run(fmt.Sprintf("audiences_%d", n), func(b *testing.B) {
+			benchEachSub(b, func(b *testing.B, pusher *VAPIDPusher, _ Subscription, i int) {
+				if i > 0 {
+					return
+				}
+				for _, endpoint := range endpoints[:n] {
+					if _, err := pusher.getCachedKeys(endpoint, time.Now()); err != nil {
+						b.Fatal(err)
+					}
+				}
+				var next atomic.Int64
+				b.RunParallel(func(pb *testing.PB) {
+					j := int(next.Add(1))
+					for pb.Next() {
+						if _, err := pusher.getCachedKeys(endpoints[j%n], time.Now()); err != nil {
+							b.Fatal(err)
+							return
+						}
+						j++
+					}
+				})
+			})
+		})
+	}
+}
+
 func benchEachSub(b *testing.B, bench func(b *testing.B, pusher *VAPIDPusher, sub Subscription, i int), options ...VAPIDPusherOption) {
 	pusher, err := NewVAPIDPusher(
 		"example@example.com",